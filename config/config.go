@@ -0,0 +1,238 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// AppBaseURL is where the frontend lives, used to build links in emails
+	AppBaseURL string
+	// RequireVerifiedEmail blocks posting and commenting until the account
+	// email is verified
+	RequireVerifiedEmail bool
+	JWT                  JWTConfig
+	Mail                 MailConfig
+	Password             PasswordPolicyConfig
+	PasswordHash         PasswordHashConfig
+	OIDCProviders        []OIDCProviderConfig
+	HTTP                 HTTPConfig
+	Feed                 FeedConfig
+}
+
+type JWTConfig struct {
+	Keys []SigningKeyConfig `json:"keys"`
+}
+
+// SigningKeyConfig describes one key of the JWT key ring. A key signs new
+// tokens from NotBefore on (the newest such key wins) and keeps verifying
+// tokens until RetireAt.
+type SigningKeyConfig struct {
+	ID             string    `json:"kid"`
+	Algorithm      string    `json:"alg"`
+	Secret         string    `json:"secret,omitempty"`
+	PrivateKeyFile string    `json:"privateKeyFile,omitempty"`
+	NotBefore      time.Time `json:"notBefore"`
+	RetireAt       time.Time `json:"retireAt"`
+}
+
+type MailConfig struct {
+	// Driver is one of smtp, file or memory
+	Driver       string
+	From         string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	FileDir      string
+}
+
+type PasswordPolicyConfig struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// BreachedListFile holds uppercase SHA-1 hashes of breached passwords,
+	// one "HASH:COUNT" per line like the Pwned Passwords dumps
+	BreachedListFile string
+}
+
+// PasswordHashConfig selects how new password hashes are made. Existing
+// hashes made with other settings are upgraded on the next login.
+type PasswordHashConfig struct {
+	// Algorithm is argon2id or bcrypt
+	Algorithm        string
+	BcryptCost       int
+	ArgonMemoryKiB   uint32
+	ArgonIterations  uint32
+	ArgonParallelism uint8
+}
+
+// HTTPConfig controls what browsers are allowed to do with the API
+type HTTPConfig struct {
+	// AllowedOrigins may make credentialed cross-origin requests
+	AllowedOrigins []string
+	// CookieSecure only sends the auth cookies over https
+	CookieSecure bool
+	// CookieHTTPOnly hides the access token cookie from scripts
+	CookieHTTPOnly bool
+}
+
+// FeedConfig picks how home timelines are built
+type FeedConfig struct {
+	// Strategy is "read" to merge followed accounts when the feed is read, or
+	// "write" to copy every new post into the timeline table of each follower.
+	// Switching to write on a running system only fills timelines from then on.
+	Strategy string
+}
+
+// OIDCProviderConfig registers an OpenID Connect provider under Name, which
+// becomes part of the login and callback urls
+type OIDCProviderConfig struct {
+	Name         string   `json:"name"`
+	IssuerURL    string   `json:"issuerUrl"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	RedirectURL  string   `json:"redirectUrl"`
+	Scopes       []string `json:"scopes"`
+}
+
+// Load reads the configuration from the environment
+func Load() (*Config, error) {
+	cfg := &Config{
+		AppBaseURL:           getEnv("APP_BASE_URL", "http://localhost:5173"),
+		RequireVerifiedEmail: getEnvBool("REQUIRE_VERIFIED_EMAIL", false),
+		Mail: MailConfig{
+			Driver:       getEnv("MAIL_DRIVER", "file"),
+			From:         getEnv("MAIL_FROM", "Natter <no-reply@natter.local>"),
+			SMTPHost:     getEnv("SMTP_HOST", "localhost"),
+			SMTPPort:     getEnvInt("SMTP_PORT", 587),
+			SMTPUsername: getEnv("SMTP_USERNAME", ""),
+			SMTPPassword: getEnv("SMTP_PASSWORD", ""),
+			FileDir:      getEnv("MAIL_FILE_DIR", "mail"),
+		},
+		Password: PasswordPolicyConfig{
+			MinLength:        getEnvInt("PASSWORD_MIN_LENGTH", 10),
+			MaxLength:        getEnvInt("PASSWORD_MAX_LENGTH", 128),
+			RequireUpper:     getEnvBool("PASSWORD_REQUIRE_UPPER", false),
+			RequireLower:     getEnvBool("PASSWORD_REQUIRE_LOWER", false),
+			RequireDigit:     getEnvBool("PASSWORD_REQUIRE_DIGIT", true),
+			RequireSymbol:    getEnvBool("PASSWORD_REQUIRE_SYMBOL", false),
+			BreachedListFile: getEnv("BREACHED_PASSWORDS_FILE", ""),
+		},
+		PasswordHash: PasswordHashConfig{
+			Algorithm:        getEnv("PASSWORD_HASH_ALGORITHM", "argon2id"),
+			BcryptCost:       getEnvInt("BCRYPT_COST", 12),
+			ArgonMemoryKiB:   uint32(getEnvInt("ARGON2_MEMORY_KIB", 64*1024)),
+			ArgonIterations:  uint32(getEnvInt("ARGON2_ITERATIONS", 3)),
+			ArgonParallelism: uint8(getEnvInt("ARGON2_PARALLELISM", 2)),
+		},
+	}
+
+	cfg.HTTP = HTTPConfig{
+		AllowedOrigins: getEnvList("CORS_ALLOWED_ORIGINS", []string{cfg.AppBaseURL}),
+		CookieSecure:   getEnvBool("COOKIE_SECURE", false),
+		CookieHTTPOnly: getEnvBool("COOKIE_HTTPONLY", true),
+	}
+
+	cfg.Feed = FeedConfig{
+		Strategy: getEnv("FEED_STRATEGY", "read"),
+	}
+
+	jwtConfig, err := loadJWTConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.JWT = *jwtConfig
+
+	if path := os.Getenv("OIDC_PROVIDERS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &cfg.OIDCProviders); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// the key ring comes from the JSON file in JWT_KEYS_FILE, otherwise a single
+// HS256 key is built from JWT_SECRET. With neither there is no safe key to
+// sign with, so startup fails.
+func loadJWTConfig() (*JWTConfig, error) {
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var jwtConfig JWTConfig
+		if err := json.Unmarshal(data, &jwtConfig); err != nil {
+			return nil, err
+		}
+
+		return &jwtConfig, nil
+	}
+
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return nil, errors.New("no JWT signing key configured, set JWT_KEYS_FILE or JWT_SECRET")
+	}
+
+	return &JWTConfig{
+		Keys: []SigningKeyConfig{{
+			ID:        "default",
+			Algorithm: "HS256",
+			Secret:    secret,
+		}},
+	}, nil
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	if value, ok := os.LookupEnv(key); ok {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+// getEnvList reads a comma separated list
+func getEnvList(key string, fallback []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
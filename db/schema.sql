@@ -0,0 +1,316 @@
+-- schema changes applied on top of the base natter database
+-- (users, posts, photos, post_likes, comments)
+
+-- login sessions: one row per login, shared by every refresh token issued
+-- from it (the token family)
+CREATE TABLE IF NOT EXISTS sessions (
+    id CHAR(32) PRIMARY KEY,
+    user_id INT NOT NULL,
+    created_at DATETIME NOT NULL,
+    revoked_at DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    session_id CHAR(32) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL,
+    FOREIGN KEY (session_id) REFERENCES sessions(id)
+);
+
+-- role based access control
+CREATE TABLE IF NOT EXISTS roles (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role_id INT NOT NULL,
+    permission_id INT NOT NULL,
+    PRIMARY KEY (role_id, permission_id),
+    FOREIGN KEY (role_id) REFERENCES roles(id),
+    FOREIGN KEY (permission_id) REFERENCES permissions(id)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INT NOT NULL,
+    role_id INT NOT NULL,
+    PRIMARY KEY (user_id, role_id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (role_id) REFERENCES roles(id)
+);
+
+INSERT IGNORE INTO roles (name) VALUES ('admin'), ('moderator');
+
+INSERT IGNORE INTO permissions (name) VALUES
+    ('posts:moderate'), ('comments:moderate'), ('users:manage'), ('roles:manage');
+
+INSERT IGNORE INTO role_permissions (role_id, permission_id)
+SELECT r.id, p.id FROM roles r JOIN permissions p
+WHERE r.name = 'admin'
+   OR (r.name = 'moderator' AND p.name IN ('posts:moderate', 'comments:moderate'));
+
+-- email verification
+ALTER TABLE users ADD COLUMN email_verified_at DATETIME NULL;
+
+-- accounts from before verification existed are grandfathered in, so turning
+-- on REQUIRE_VERIFIED_EMAIL doesn't lock them out of posting
+UPDATE users SET email_verified_at = NOW() WHERE email_verified_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+    jti CHAR(32) PRIMARY KEY,
+    user_id INT NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    used_at DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- password reset
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- totp two-factor authentication
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id INT PRIMARY KEY,
+    secret VARCHAR(64) NOT NULL,
+    created_at DATETIME NOT NULL,
+    confirmed_at DATETIME NULL,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS login_challenges (
+    token_hash CHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    used_at DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- personal access tokens
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    token_prefix CHAR(12) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    scopes VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    last_used_at DATETIME NULL,
+    expires_at DATETIME NULL,
+    revoked_at DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- login brute-force protection
+CREATE TABLE IF NOT EXISTS login_attempts (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    ip VARCHAR(45) NOT NULL,
+    succeeded BOOLEAN NOT NULL,
+    created_at DATETIME NOT NULL,
+    INDEX idx_login_attempts_ip (ip, created_at)
+);
+
+-- keyed by the submitted email so unknown accounts behave like real ones
+CREATE TABLE IF NOT EXISTS login_throttles (
+    email VARCHAR(255) PRIMARY KEY,
+    failed_count INT NOT NULL DEFAULT 0,
+    last_failed_at DATETIME NOT NULL,
+    locked_until DATETIME NULL
+);
+
+CREATE TABLE IF NOT EXISTS account_unlock_tokens (
+    token_hash CHAR(64) PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL
+);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    event VARCHAR(100) NOT NULL,
+    user_id INT NULL,
+    actor_id INT NULL,
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    detail VARCHAR(1000) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    INDEX idx_audit_events_user (user_id, created_at)
+);
+
+-- richer profiles
+ALTER TABLE users
+    ADD COLUMN display_name VARCHAR(50) NOT NULL DEFAULT '',
+    ADD COLUMN bio VARCHAR(160) NOT NULL DEFAULT '',
+    ADD COLUMN location VARCHAR(30) NOT NULL DEFAULT '',
+    ADD COLUMN website VARCHAR(100) NOT NULL DEFAULT '',
+    ADD COLUMN banner_url VARCHAR(500) NOT NULL DEFAULT '',
+    ADD COLUMN created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD COLUMN username_changed_at DATETIME NULL;
+
+-- old usernames keep redirecting to the account that used them
+CREATE TABLE IF NOT EXISTS username_history (
+    old_username VARCHAR(30) PRIMARY KEY,
+    user_id INT NOT NULL,
+    changed_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- openid connect login
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+    state_hash CHAR(64) PRIMARY KEY,
+    provider VARCHAR(50) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_id INT NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (provider, subject),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- passwordless login links
+CREATE TABLE IF NOT EXISTS magic_link_tokens (
+    jti CHAR(32) PRIMARY KEY,
+    user_id INT NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- every request is counted, known email or not, so the limit gives nothing away
+CREATE TABLE IF NOT EXISTS magic_link_requests (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    requested_at DATETIME NOT NULL,
+    INDEX (email, requested_at)
+);
+
+-- device details for the active sessions list
+ALTER TABLE sessions
+    ADD COLUMN user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN ip VARCHAR(45) NOT NULL DEFAULT '',
+    ADD COLUMN last_seen_at DATETIME NULL;
+
+-- admin impersonation, the session belongs to the impersonated user
+ALTER TABLE sessions
+    ADD COLUMN impersonator_id INT NULL,
+    ADD COLUMN read_only BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN expires_at DATETIME NULL,
+    ADD FOREIGN KEY (impersonator_id) REFERENCES users(id);
+
+-- social graph, pending rows are follow requests to private accounts
+ALTER TABLE users
+    ADD COLUMN is_private BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS follows (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    follower_id INT NOT NULL,
+    followee_id INT NOT NULL,
+    status ENUM('pending', 'accepted') NOT NULL,
+    created_at DATETIME NOT NULL,
+    accepted_at DATETIME NULL,
+    UNIQUE KEY uq_follows_pair (follower_id, followee_id),
+    INDEX idx_follows_followee (followee_id, status, id),
+    INDEX idx_follows_follower (follower_id, status, id),
+    FOREIGN KEY (follower_id) REFERENCES users(id),
+    FOREIGN KEY (followee_id) REFERENCES users(id)
+);
+
+-- precomputed home timelines, only filled with FEED_STRATEGY=write
+CREATE TABLE IF NOT EXISTS home_timeline (
+    user_id INT NOT NULL,
+    post_id INT NOT NULL,
+    author_id INT NOT NULL,
+    PRIMARY KEY (user_id, post_id),
+    INDEX idx_home_timeline_author (user_id, author_id),
+    INDEX idx_home_timeline_post (post_id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (post_id) REFERENCES posts(id),
+    FOREIGN KEY (author_id) REFERENCES users(id)
+);
+
+-- blocks hide both users from each other, mutes only hide the muted user
+-- from the feeds of the one who muted
+CREATE TABLE IF NOT EXISTS blocks (
+    blocker_id INT NOT NULL,
+    blocked_id INT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (blocker_id, blocked_id),
+    INDEX idx_blocks_blocked (blocked_id),
+    FOREIGN KEY (blocker_id) REFERENCES users(id),
+    FOREIGN KEY (blocked_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS mutes (
+    muter_id INT NOT NULL,
+    muted_id INT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (muter_id, muted_id),
+    FOREIGN KEY (muter_id) REFERENCES users(id),
+    FOREIGN KEY (muted_id) REFERENCES users(id)
+);
+
+-- public, followers, private or unlisted
+ALTER TABLE posts
+    ADD COLUMN visibility VARCHAR(16) NOT NULL DEFAULT 'public';
+
+-- threaded comments: depth is 0 for comments on the post itself. Removing a
+-- comment with replies only blanks it and sets deleted_at, removing a whole
+-- post takes its threads along.
+ALTER TABLE comments
+    ADD COLUMN parent_id INT NULL,
+    ADD COLUMN depth INT NOT NULL DEFAULT 0,
+    ADD COLUMN deleted_at DATETIME NULL,
+    ADD INDEX idx_comments_parent (parent_id),
+    ADD FOREIGN KEY (parent_id) REFERENCES comments(id) ON DELETE CASCADE;
+
+-- placeholders of deleted accounts keep their place in the thread without
+-- an author
+ALTER TABLE comments
+    MODIFY user_id INT NULL;
+
+-- accounts created through an identity provider have no password, they
+-- confirm sensitive changes by logging in with the provider again
+ALTER TABLE oidc_login_states
+    ADD COLUMN reauth_session_id CHAR(32) NULL;
+
+ALTER TABLE sessions
+    ADD COLUMN reauthenticated_at DATETIME NULL;
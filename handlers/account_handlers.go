@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"natter-chat-go/services"
+	"net/http"
+)
+
+func ChangePasswordHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		var body struct {
+			CurrentPassword string `json:"currentPassword"`
+			NewPassword     string `json:"newPassword"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := services.ChangePassword(db, principal.UserID, principal.SessionID, body.CurrentPassword, body.NewPassword)
+		if err != nil {
+			writeAccountError(w, err, "Error changing password: ")
+			return
+		}
+
+		json.NewEncoder(w).Encode("Password changed successfully")
+	}
+}
+
+func ChangeEmailHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		var body struct {
+			CurrentPassword string `json:"currentPassword"`
+			NewEmail        string `json:"newEmail"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := services.ChangeEmail(db, principal.UserID, principal.SessionID, body.CurrentPassword, body.NewEmail)
+		if err != nil {
+			writeAccountError(w, err, "Error changing email: ")
+			return
+		}
+
+		json.NewEncoder(w).Encode("Email changed, check your inbox to verify it")
+	}
+}
+
+func DeleteAccountHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		var body struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := services.DeleteAccount(db, principal.UserID, principal.SessionID, body.Password)
+		if err != nil {
+			writeAccountError(w, err, "Error deleting account: ")
+			return
+		}
+
+		clearAuthCookies(w)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeAccountError(w http.ResponseWriter, err error, msg string) {
+	switch err {
+	case services.ErrWrongPassword, services.ErrReauthenticationRequired:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case services.ErrEmailTaken:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case services.ErrInvalidEmail:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		writeServiceError(w, err, msg)
+	}
+}
+
+func ConfigureAccountRoutes(router *http.ServeMux, db *sql.DB) {
+	router.HandleFunc("PUT /api/account/password", Interactive(db, ChangePasswordHandler(db)))
+	router.HandleFunc("PUT /api/account/email", Interactive(db, ChangeEmailHandler(db)))
+	router.HandleFunc("DELETE /api/account", Interactive(db, DeleteAccountHandler(db)))
+}
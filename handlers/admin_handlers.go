@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"natter-chat-go/services"
+	"net/http"
+	"strconv"
+)
+
+func ListUsersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		users, err := services.ListUsersWithRoles(db)
+		if err != nil {
+			http.Error(w, "Error fetching users: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(users)
+	}
+}
+
+func ListRolesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		roles, err := services.ListRoles(db)
+		if err != nil {
+			http.Error(w, "Error fetching roles: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(roles)
+	}
+}
+
+func GetUserRolesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		userID, err := strconv.Atoi(r.PathValue("userID"))
+		if err != nil {
+			http.Error(w, "Invalid ID. Must be a positive number."+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		roles, err := services.GetUserRoles(db, userID)
+		if err != nil {
+			http.Error(w, "Error fetching user roles: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(roles)
+	}
+}
+
+// grant or revoke a role
+func ModifyUserRoleHandler(db *sql.DB, action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		userID, err := strconv.Atoi(r.PathValue("userID"))
+		if err != nil {
+			http.Error(w, "Invalid ID. Must be a positive number."+err.Error(), http.StatusBadRequest)
+			return
+		}
+		role := r.PathValue("role")
+
+		principal, _ := PrincipalFromContext(r.Context())
+		if action == "grant" {
+			err = services.GrantRole(db, userID, role)
+		} else {
+			err = services.RevokeRole(db, principal.Actor(), userID, role)
+		}
+
+		switch err {
+		case nil:
+		case services.ErrUnknownRole, sql.ErrNoRows:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case services.ErrRoleAlreadyGranted, services.ErrRoleNotGranted:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case services.ErrRevokeOwnAdmin:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		default:
+			http.Error(w, "Error modifying user role: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		roles, err := services.GetUserRoles(db, userID)
+		if err != nil {
+			http.Error(w, "Error fetching user roles: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(roles)
+	}
+}
+
+// issue a session acting as another user, returned in the body so the admin
+// keeps their own cookies
+func ImpersonateUserHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		userID, err := strconv.Atoi(r.PathValue("userID"))
+		if err != nil {
+			http.Error(w, "Invalid ID. Must be a positive number."+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		principal, _ := PrincipalFromContext(r.Context())
+		if principal.ImpersonatorID != 0 || principal.APITokenID != 0 {
+			http.Error(w, "Forbidden: impersonation needs a regular admin session", http.StatusForbidden)
+			return
+		}
+
+		var body struct {
+			Reason   string `json:"reason"`
+			ReadOnly *bool  `json:"readOnly"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// read-only unless asked otherwise
+		readOnly := body.ReadOnly == nil || *body.ReadOnly
+
+		tokens, err := services.StartImpersonation(db, principal.Actor(), userID, body.Reason, readOnly, clientInfo(r))
+		if err != nil {
+			writeServiceError(w, err, "Error starting impersonation: ")
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(tokens)
+	}
+}
+
+func EndImpersonationHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := PrincipalFromContext(r.Context())
+
+		if err := services.EndImpersonation(db, principal.SessionID, clientIP(r)); err != nil {
+			writeServiceError(w, err, "Error ending impersonation: ")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ConfigureAdminRoutes(router *http.ServeMux, db *sql.DB) {
+	router.HandleFunc("GET /api/admin/users", WithPermission(db, services.PermManageUsers, ListUsersHandler(db)))
+	router.HandleFunc("GET /api/admin/roles", WithPermission(db, services.PermManageRoles, ListRolesHandler(db)))
+	router.HandleFunc("GET /api/admin/users/{userID}/roles", WithPermission(db, services.PermManageRoles, GetUserRolesHandler(db)))
+	router.HandleFunc("PUT /api/admin/users/{userID}/roles/{role}", WithPermission(db, services.PermManageRoles, ModifyUserRoleHandler(db, "grant")))
+	router.HandleFunc("DELETE /api/admin/users/{userID}/roles/{role}", WithPermission(db, services.PermManageRoles, ModifyUserRoleHandler(db, "revoke")))
+	router.HandleFunc("POST /api/admin/users/{userID}/impersonate", WithPermission(db, services.PermManageUsers, ImpersonateUserHandler(db)))
+	router.HandleFunc("DELETE /api/admin/impersonation", Impersonating(db, EndImpersonationHandler(db)))
+}
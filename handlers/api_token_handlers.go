@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"natter-chat-go/models"
+	"natter-chat-go/services"
+	"net/http"
+	"strconv"
+)
+
+func CreateAPITokenHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		var request models.CreateAPITokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		token, err := services.CreateAPIToken(db, principal.UserID, request)
+		if err != nil {
+			if errors.Is(err, services.ErrAPITokenInput) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Error creating api token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(token)
+	}
+}
+
+func ListAPITokensHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		tokens, err := services.ListAPITokens(db, principal.UserID)
+		if err != nil {
+			http.Error(w, "Error fetching api tokens: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(tokens)
+	}
+}
+
+func RevokeAPITokenHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		tokenID, err := strconv.Atoi(r.PathValue("tokenID"))
+		if err != nil {
+			http.Error(w, "Invalid ID. Must be a positive number."+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		principal, _ := PrincipalFromContext(r.Context())
+		err = services.RevokeAPIToken(db, principal.UserID, tokenID)
+		if err != nil {
+			writeServiceError(w, err, "Error revoking api token: ")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ConfigureAPITokenRoutes(router *http.ServeMux, db *sql.DB) {
+	router.HandleFunc("GET /api/tokens", Interactive(db, ListAPITokensHandler(db)))
+	router.HandleFunc("POST /api/tokens", Interactive(db, CreateAPITokenHandler(db)))
+	router.HandleFunc("DELETE /api/tokens/{tokenID}", Interactive(db, RevokeAPITokenHandler(db)))
+}
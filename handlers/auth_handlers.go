@@ -3,10 +3,11 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"natter-chat-go/models"
 	"natter-chat-go/services"
 	"net/http"
-	"time"
+	"strconv"
 )
 
 func Login(db *sql.DB) http.HandlerFunc {
@@ -23,43 +24,143 @@ func Login(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		user, err := services.Login(db, creds.Email, creds.Password)
+		result, err := services.Login(db, creds.Email, creds.Password, clientInfo(r))
 		if err != nil {
-			http.Error(w, "Credenciales inválidas", http.StatusUnauthorized)
+			var throttled *services.LoginThrottledError
+			switch {
+			case errors.As(err, &throttled):
+				w.Header().Set("Retry-After", strconv.Itoa(int(throttled.RetryAfter.Seconds())+1))
+				http.Error(w, throttled.Error(), http.StatusTooManyRequests)
+			case err == services.ErrAccountLocked:
+				http.Error(w, err.Error(), http.StatusLocked)
+			case err == services.ErrInvalidCredentials:
+				http.Error(w, "Credenciales inválidas", http.StatusUnauthorized)
+			default:
+				http.Error(w, "Error logging in: "+err.Error(), http.StatusInternalServerError)
+			}
 			return
 		}
 
-		// set the token in a cookie
-		cookie := http.Cookie{
-			Name:     "token",
-			Value:    user.Token,
-			Expires:  time.Now().Add(24 * time.Hour),
-			HttpOnly: false,
-			Secure:   false,
-			SameSite: http.SameSiteLaxMode,
-			Path:     "/",
+		// no cookie until the second factor is completed
+		if result.Challenge != nil {
+			json.NewEncoder(w).Encode(struct {
+				TwoFactorRequired bool `json:"twoFactorRequired"`
+				*models.TwoFactorChallenge
+			}{true, result.Challenge})
+			return
+		}
+
+		setAuthCookies(w, result.Tokens)
+		json.NewEncoder(w).Encode(result.User)
+	}
+}
+
+// second login step for accounts with two-factor enabled
+func LoginTwoFactor(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var body struct {
+			Challenge    string `json:"challenge"`
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recoveryCode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		user.Token = ""
+		// logins through an identity provider leave the challenge in a cookie
+		if body.Challenge == "" {
+			body.Challenge, _ = getCookieValue(r, loginChallengeCookieName)
+		}
+
+		user, tokens, err := services.CompleteTwoFactorLogin(db, body.Challenge, body.Code, body.RecoveryCode, clientInfo(r))
+		if err != nil {
+			var throttled *services.LoginThrottledError
+			switch {
+			case errors.As(err, &throttled):
+				w.Header().Set("Retry-After", strconv.Itoa(int(throttled.RetryAfter.Seconds())+1))
+				http.Error(w, throttled.Error(), http.StatusTooManyRequests)
+			case err == services.ErrAccountLocked:
+				http.Error(w, err.Error(), http.StatusLocked)
+			case err == services.ErrInvalidLoginChallenge, err == services.ErrInvalidTwoFactorCode, err == services.ErrTOTPNotEnrolled:
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+			default:
+				http.Error(w, "Error completing login: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
 
-		http.SetCookie(w, &cookie)
+		clearLoginChallengeCookie(w)
+		setAuthCookies(w, tokens)
 		json.NewEncoder(w).Encode(user)
 	}
 }
 
 func Logout(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie := http.Cookie{
-			Name:     "token",
-			Value:    "",
-			Expires:  time.Now().AddDate(0, 0, -1),
-			HttpOnly: false,
-			Secure:   false,
-			SameSite: http.SameSiteLaxMode,
-			Path:     "/",
+		// revoke the server-side session so the tokens stop working right away
+		if sessionID, err := extractSessionIDFromToken(r); err == nil {
+			if err := services.RevokeSession(db, sessionID); err != nil {
+				http.Error(w, "Error revoking session: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else if refreshToken, err := getCookieValue(r, refreshCookieName); err == nil {
+			err := services.RevokeSessionByRefreshToken(db, refreshToken)
+			if err != nil && err != services.ErrInvalidRefreshToken {
+				http.Error(w, "Error revoking session: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
 		}
 
-		http.SetCookie(w, &cookie)
+		clearAuthCookies(w)
+	}
+}
+
+// rotate the refresh token and issue a new access token
+func Refresh(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		refreshToken, err := getCookieValue(r, refreshCookieName)
+		fromCookie := err == nil
+		if !fromCookie {
+			var body struct {
+				RefreshToken string `json:"refreshToken"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+				http.Error(w, "Refresh token not found", http.StatusUnauthorized)
+				return
+			}
+			refreshToken = body.RefreshToken
+		}
+
+		tokens, err := services.RefreshSession(db, refreshToken)
+		if err != nil {
+			switch err {
+			case services.ErrInvalidRefreshToken, services.ErrRefreshTokenReused, services.ErrSessionRevoked:
+				clearAuthCookies(w)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+			default:
+				http.Error(w, "Error refreshing session: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		setAuthCookies(w, tokens)
+
+		// a refresh token kept in the HttpOnly cookie must not become
+		// readable by scripts through the response
+		if fromCookie {
+			json.NewEncoder(w).Encode(struct {
+				AccessToken     string `json:"accessToken"`
+				AccessExpiresAt int64  `json:"accessExpiresAt"`
+			}{tokens.AccessToken, tokens.AccessExpiresAt})
+			return
+		}
+
+		json.NewEncoder(w).Encode(tokens)
 	}
 }
 
@@ -78,7 +179,7 @@ func Register(db *sql.DB) http.HandlerFunc {
 		userID, err := services.Register(db, register)
 
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeServiceError(w, err, "Error registering user: ")
 			return
 		}
 
@@ -87,8 +188,196 @@ func Register(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+func VerifyEmail(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		err := services.VerifyEmail(db, r.URL.Query().Get("token"))
+		if err != nil {
+			if err == services.ErrInvalidVerificationToken {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Error verifying email: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode("Email verified successfully")
+	}
+}
+
+func ResendVerification(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		err := services.ResendVerificationEmail(db, principal.UserID)
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode("Verification email sent")
+		case services.ErrAlreadyVerified:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case services.ErrTooManyRequests:
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		default:
+			http.Error(w, "Error sending verification email: "+err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// always answers the same way so the endpoint can't be used to find accounts
+func ForgotPassword(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var body struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := services.RequestPasswordReset(db, body.Email); err != nil {
+			http.Error(w, "Error requesting password reset: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode("If the email is registered, a reset link has been sent")
+	}
+}
+
+func ResetPassword(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var body struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := services.ResetPassword(db, body.Token, body.Password)
+		if err != nil {
+			if err == services.ErrInvalidResetToken {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeServiceError(w, err, "Error resetting password: ")
+			return
+		}
+
+		clearAuthCookies(w)
+		json.NewEncoder(w).Encode("Password reset successfully")
+	}
+}
+
+func UnlockAccount(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var body struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := services.UnlockAccount(db, body.Token, clientIP(r))
+		if err != nil {
+			if err == services.ErrInvalidUnlockLink {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Error unlocking account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode("Account unlocked successfully")
+	}
+}
+
+// always answers the same way so the endpoint can't be used to find accounts
+func RequestMagicLink(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var body struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := services.RequestMagicLink(db, body.Email)
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode("If the email is registered, a login link has been sent")
+		case services.ErrTooManyRequests:
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		default:
+			http.Error(w, "Error sending login link: "+err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// the page the emailed link opens posts the token here, a plain GET would
+// let link scanners in mail clients burn it
+func ConsumeMagicLink(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var body struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err := services.ConsumeMagicLink(db, body.Token, clientInfo(r))
+		if err != nil {
+			if err == services.ErrInvalidMagicLink {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, "Error logging in: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if result.Challenge != nil {
+			json.NewEncoder(w).Encode(struct {
+				TwoFactorRequired bool `json:"twoFactorRequired"`
+				*models.TwoFactorChallenge
+			}{true, result.Challenge})
+			return
+		}
+
+		setAuthCookies(w, result.Tokens)
+		json.NewEncoder(w).Encode(result.User)
+	}
+}
+
 func ConfigureAuthRoutes(muxRouter *http.ServeMux, db *sql.DB) {
+	muxRouter.HandleFunc("GET /api/auth/csrf", CSRFToken())
 	muxRouter.HandleFunc("POST /api/auth/login", Login(db))
+	muxRouter.HandleFunc("POST /api/auth/login/2fa", LoginTwoFactor(db))
 	muxRouter.HandleFunc("POST /api/auth/register", Register(db))
 	muxRouter.HandleFunc("POST /api/auth/logout", Logout(db))
+	muxRouter.HandleFunc("POST /api/auth/refresh", Refresh(db))
+	muxRouter.HandleFunc("GET /api/auth/verify", VerifyEmail(db))
+	muxRouter.HandleFunc("POST /api/auth/verify/resend", Interactive(db, ResendVerification(db)))
+	muxRouter.HandleFunc("POST /api/auth/password/forgot", ForgotPassword(db))
+	muxRouter.HandleFunc("POST /api/auth/password/reset", ResetPassword(db))
+	muxRouter.HandleFunc("POST /api/auth/unlock", UnlockAccount(db))
+	muxRouter.HandleFunc("POST /api/auth/magic-link", RequestMagicLink(db))
+	muxRouter.HandleFunc("POST /api/auth/magic-link/callback", ConsumeMagicLink(db))
 }
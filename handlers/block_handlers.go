@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"database/sql"
+	"natter-chat-go/models"
+	"natter-chat-go/services"
+	"net/http"
+)
+
+// block, unblock, mute or unmute a user
+func ModifyRestrictionHandler(db *sql.DB, action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+		username := r.PathValue("username")
+
+		var err error
+		switch action {
+		case "block":
+			err = services.BlockUser(db, principal.UserID, username)
+		case "unblock":
+			err = services.UnblockUser(db, principal.UserID, username)
+		case "mute":
+			err = services.MuteUser(db, principal.UserID, username)
+		default:
+			err = services.UnmuteUser(db, principal.UserID, username)
+		}
+		if err != nil {
+			writeServiceError(w, err, "Error trying to "+action+" user: ")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// users the caller blocked or muted
+func ListRestrictedUsersHandler(db *sql.DB, list string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+		page, err := parsePageRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var users []models.RestrictedUser
+		var info models.PageInfo
+		if list == "blocks" {
+			users, info, err = services.ListBlockedUsers(db, principal.UserID, page)
+		} else {
+			users, info, err = services.ListMutedUsers(db, principal.UserID, page)
+		}
+		if err != nil {
+			http.Error(w, "Error fetching "+list+": "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writePage(w, r, users, info)
+	}
+}
+
+func ConfigureBlockRoutes(router *http.ServeMux, db *sql.DB) {
+	router.HandleFunc("GET /api/users/me/blocks", Authenticated(db, WithScope(services.ScopeBlocksRead, ListRestrictedUsersHandler(db, "blocks"))))
+	router.HandleFunc("GET /api/users/me/mutes", Authenticated(db, WithScope(services.ScopeBlocksRead, ListRestrictedUsersHandler(db, "mutes"))))
+	router.HandleFunc("PUT /api/users/{username}/block", Authenticated(db, WithScope(services.ScopeBlocksWrite, ModifyRestrictionHandler(db, "block"))))
+	router.HandleFunc("DELETE /api/users/{username}/block", Authenticated(db, WithScope(services.ScopeBlocksWrite, ModifyRestrictionHandler(db, "unblock"))))
+	router.HandleFunc("PUT /api/users/{username}/mute", Authenticated(db, WithScope(services.ScopeBlocksWrite, ModifyRestrictionHandler(db, "mute"))))
+	router.HandleFunc("DELETE /api/users/{username}/mute", Authenticated(db, WithScope(services.ScopeBlocksWrite, ModifyRestrictionHandler(db, "unmute"))))
+}
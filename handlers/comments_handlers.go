@@ -3,6 +3,7 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"natter-chat-go/models"
 	"natter-chat-go/services"
 	"net/http"
@@ -25,10 +26,13 @@ func HandlePostComment(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// the author is always the caller, never what the client sent
+		principal, _ := PrincipalFromContext(r.Context())
+		comment.UserID = principal.UserID
 		comment.PostID = postID
 		_, err = services.CreateComment(db, &comment)
 		if err != nil {
-			http.Error(w, "Error creating comment: "+err.Error(), http.StatusInternalServerError)
+			writeServiceError(w, err, "Error creating comment: ")
 			return
 		}
 
@@ -45,9 +49,10 @@ func HandleDeleteComment(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		err = services.DeleteComment(db, commentID)
+		principal, _ := PrincipalFromContext(r.Context())
+		err = services.DeleteComment(db, principal.Actor(), commentID)
 		if err != nil {
-			http.Error(w, "Error deleting comment: "+err.Error(), http.StatusInternalServerError)
+			writeServiceError(w, err, "Error deleting comment: ")
 			return
 		}
 
@@ -64,18 +69,77 @@ func HandleGetPostComments(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		comments, err := services.GetPostComments(db, postID)
+		page, err := parsePageRequest(r)
 		if err != nil {
-			http.Error(w, "Error fetching comments: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		json.NewEncoder(w).Encode(comments)
+		depth, err := parseReplyDepth(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		comments, info, err := services.GetPostComments(db, viewerID(r), postID, depth, page)
+		if err != nil {
+			writeServiceError(w, err, "Error fetching comments: ")
+			return
+		}
+
+		writePage(w, r, comments, info)
+	}
+}
+
+// load more replies of a comment
+func HandleGetCommentReplies(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		commentID, err := strconv.Atoi(r.PathValue("commentID"))
+		if err != nil {
+			http.Error(w, "Invalid ID. Must be a positive number."+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		page, err := parsePageRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		depth, err := parseReplyDepth(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		replies, info, err := services.GetCommentReplies(db, viewerID(r), commentID, depth, page)
+		if err != nil {
+			writeServiceError(w, err, "Error fetching replies: ")
+			return
+		}
+
+		writePage(w, r, replies, info)
+	}
+}
+
+// parseReplyDepth reads how many levels of replies to load from ?depth=
+func parseReplyDepth(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("depth")
+	if value == "" {
+		return services.DefaultReplyDepth, nil
+	}
+
+	depth, err := strconv.Atoi(value)
+	if err != nil || depth < 0 || depth > services.MaxReplyDepth {
+		return 0, fmt.Errorf("depth must be between 0 and %d", services.MaxReplyDepth)
 	}
+	return depth, nil
 }
 
 func ConfigureCommentsRoutes(router *http.ServeMux, db *sql.DB) {
-	router.HandleFunc("POST /api/comments/{postID}", HandlePostComment(db))
-	router.HandleFunc("DELETE /api/comments/{commentID}", HandleDeleteComment(db))
-	router.HandleFunc("GET /api/comments/{postID}", HandleGetPostComments(db))
+	router.HandleFunc("POST /api/comments/{postID}", Verified(db, WithScope(services.ScopeCommentsWrite, HandlePostComment(db))))
+	router.HandleFunc("DELETE /api/comments/{commentID}", Authenticated(db, WithScope(services.ScopeCommentsWrite, HandleDeleteComment(db))))
+	router.HandleFunc("GET /api/comments/{postID}", Public(db, WithScope(services.ScopeCommentsRead, HandleGetPostComments(db))))
+	router.HandleFunc("GET /api/comments/{commentID}/replies", Public(db, WithScope(services.ScopeCommentsRead, HandleGetCommentReplies(db))))
 }
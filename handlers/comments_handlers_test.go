@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"natter-chat-go/services"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParseReplyDepth(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    int
+		wantErr bool
+	}{
+		{"default", "", services.DefaultReplyDepth, false},
+		{"none", "?depth=0", 0, false},
+		{"deepest allowed", "?depth=" + strconv.Itoa(services.MaxReplyDepth), services.MaxReplyDepth, false},
+		{"too deep", "?depth=" + strconv.Itoa(services.MaxReplyDepth+1), 0, true},
+		{"negative", "?depth=-1", 0, true},
+		{"not a number", "?depth=all", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/comments/1"+tt.query, nil)
+			depth, err := parseReplyDepth(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseReplyDepth(%q) error = %v, want error: %v", tt.query, err, tt.wantErr)
+			}
+			if depth != tt.want {
+				t.Errorf("parseReplyDepth(%q) = %d, want %d", tt.query, depth, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"natter-chat-go/config"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+var httpConfig = config.HTTPConfig{CookieHTTPOnly: true}
+
+// SetHTTPConfig installs the cookie flags and the origin allowlist
+func SetHTTPConfig(cfg config.HTTPConfig) {
+	httpConfig = cfg
+}
+
+// OriginAllowed reports whether origin may make credentialed requests
+func OriginAllowed(origin string) bool {
+	return slices.Contains(httpConfig.AllowedOrigins, origin)
+}
+
+// setCSRFCookie issues a new double-submit token. The cookie is readable by
+// scripts on purpose, the token is also sent in a header for frontends on
+// another domain that can't read it.
+func setCSRFCookie(w http.ResponseWriter, expires time.Time) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Expires:  expires,
+		HttpOnly: false,
+		Secure:   httpConfig.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+	w.Header().Set(csrfHeaderName, token)
+
+	return token, nil
+}
+
+// hands out the CSRF token of the current browser, issuing one if needed
+func CSRFToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		token, err := getCookieValue(r, csrfCookieName)
+		if err != nil || token == "" {
+			token, err = setCSRFCookie(w, time.Now().Add(24*time.Hour))
+			if err != nil {
+				http.Error(w, "Error issuing CSRF token: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		json.NewEncoder(w).Encode(struct {
+			CSRFToken string `json:"csrfToken"`
+		}{token})
+	}
+}
+
+// CSRFProtect guards every state-changing request. Browsers must come from an
+// allowed origin, and requests that carry auth cookies must echo the CSRF
+// cookie in the X-CSRF-Token header. Requests with an Authorization header
+// are left alone, no browser attaches one on its own.
+func CSRFProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if origin := r.Header.Get("Origin"); origin != "" && !OriginAllowed(origin) && !isSameOrigin(r, origin) {
+			writeJSONError(w, http.StatusForbidden, "origin_not_allowed", "Cross-origin request blocked")
+			return
+		}
+
+		if r.Header.Get("Authorization") != "" || !hasAuthCookie(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookieToken, err := getCookieValue(r, csrfCookieName)
+		headerToken := r.Header.Get(csrfHeaderName)
+		if err != nil || cookieToken == "" || subtle.ConstantTimeCompare([]byte(cookieToken), []byte(headerToken)) != 1 {
+			writeJSONError(w, http.StatusForbidden, "csrf_failed", "Missing or invalid CSRF token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hasAuthCookie(r *http.Request) bool {
+	for _, name := range []string{tokenCookieName, refreshCookieName, loginChallengeCookieName} {
+		if _, err := getCookieValue(r, name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func isSameOrigin(r *http.Request, origin string) bool {
+	parsed, err := url.Parse(origin)
+	return err == nil && parsed.Host == r.Host
+}
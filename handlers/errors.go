@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"natter-chat-go/services"
+	"net/http"
+)
+
+type errorResponse struct {
+	Error      string            `json:"error"`
+	Message    string            `json:"message"`
+	Violations []string          `json:"violations,omitempty"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: code, Message: message})
+}
+
+// writeServiceError maps policy and lookup errors to their status codes and
+// falls back to a 500 prefixed with msg
+func writeServiceError(w http.ResponseWriter, err error, msg string) {
+	var policyErr *services.PolicyError
+	var passwordErr *services.PasswordPolicyError
+	var validationErr *services.ValidationError
+	switch {
+	case errors.As(err, &policyErr):
+		writeJSONError(w, http.StatusForbidden, "forbidden", policyErr.Error())
+	case errors.As(err, &passwordErr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse{
+			Error:      "invalid_password",
+			Message:    passwordErr.Error(),
+			Violations: passwordErr.Violations,
+		})
+	case errors.As(err, &validationErr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse{
+			Error:   "validation_failed",
+			Message: validationErr.Error(),
+			Fields:  validationErr.Fields,
+		})
+	case errors.Is(err, sql.ErrNoRows):
+		writeJSONError(w, http.StatusNotFound, "not_found", "resource not found")
+	default:
+		http.Error(w, msg+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"database/sql"
+	"natter-chat-go/services"
+	"net/http"
+)
+
+// posts of the caller and everyone they follow
+func GetHomeFeedHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+		page, err := parsePageRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		posts, info, err := services.GetHomeTimeline(db, principal.UserID, page)
+		if err != nil {
+			http.Error(w, "Error fetching home feed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writePage(w, r, posts, info)
+	}
+}
+
+func ConfigureFeedRoutes(router *http.ServeMux, db *sql.DB) {
+	router.HandleFunc("GET /api/feed/home", Authenticated(db, WithScope(services.ScopePostsRead, GetHomeFeedHandler(db))))
+}
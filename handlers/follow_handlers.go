@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"natter-chat-go/models"
+	"natter-chat-go/services"
+	"net/http"
+)
+
+func viewerID(r *http.Request) int {
+	if principal, ok := PrincipalFromContext(r.Context()); ok {
+		return principal.UserID
+	}
+	return 0
+}
+
+// followers or following of a user
+func ListFollowsHandler(db *sql.DB, list string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		page, err := parsePageRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var users []models.FollowUser
+		var info models.PageInfo
+		if list == "followers" {
+			users, info, err = services.ListFollowers(db, viewerID(r), r.PathValue("username"), page)
+		} else {
+			users, info, err = services.ListFollowing(db, viewerID(r), r.PathValue("username"), page)
+		}
+		if err != nil {
+			writeServiceError(w, err, "Error fetching "+list+": ")
+			return
+		}
+
+		writePage(w, r, users, info)
+	}
+}
+
+func GetFollowStatusHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		status, err := services.GetFollowStatus(db, principal.UserID, r.PathValue("username"))
+		if err != nil {
+			writeServiceError(w, err, "Error fetching follow status: ")
+			return
+		}
+
+		json.NewEncoder(w).Encode(models.FollowStatus{Status: status})
+	}
+}
+
+// follow or unfollow a user, following a private account sends a request
+func ModifyFollowHandler(db *sql.DB, action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+		username := r.PathValue("username")
+
+		if action == "unfollow" {
+			if err := services.Unfollow(db, principal.UserID, username); err != nil {
+				writeServiceError(w, err, "Error unfollowing user: ")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		status, err := services.Follow(db, principal.UserID, username)
+		if err != nil {
+			writeServiceError(w, err, "Error following user: ")
+			return
+		}
+
+		json.NewEncoder(w).Encode(models.FollowStatus{Status: status})
+	}
+}
+
+func RemoveFollowerHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		if err := services.RemoveFollower(db, principal.UserID, r.PathValue("username")); err != nil {
+			writeServiceError(w, err, "Error removing follower: ")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ListFollowRequestsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+		page, err := parsePageRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		users, info, err := services.ListFollowRequests(db, principal.UserID, page)
+		if err != nil {
+			http.Error(w, "Error fetching follow requests: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writePage(w, r, users, info)
+	}
+}
+
+// accept or reject a follow request
+func AnswerFollowRequestHandler(db *sql.DB, action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+		username := r.PathValue("username")
+
+		var err error
+		if action == "accept" {
+			err = services.AcceptFollowRequest(db, principal.UserID, username)
+		} else {
+			err = services.RejectFollowRequest(db, principal.UserID, username)
+		}
+		if err != nil {
+			writeServiceError(w, err, "Error answering follow request: ")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ConfigureFollowRoutes(router *http.ServeMux, db *sql.DB) {
+	router.HandleFunc("GET /api/users/{username}/followers", Public(db, WithScope(services.ScopeFollowsRead, ListFollowsHandler(db, "followers"))))
+	router.HandleFunc("GET /api/users/{username}/following", Public(db, WithScope(services.ScopeFollowsRead, ListFollowsHandler(db, "following"))))
+	router.HandleFunc("GET /api/users/{username}/follow", Authenticated(db, WithScope(services.ScopeFollowsRead, GetFollowStatusHandler(db))))
+	router.HandleFunc("PUT /api/users/{username}/follow", Authenticated(db, WithScope(services.ScopeFollowsWrite, ModifyFollowHandler(db, "follow"))))
+	router.HandleFunc("DELETE /api/users/{username}/follow", Authenticated(db, WithScope(services.ScopeFollowsWrite, ModifyFollowHandler(db, "unfollow"))))
+	router.HandleFunc("DELETE /api/users/me/followers/{username}", Authenticated(db, WithScope(services.ScopeFollowsWrite, RemoveFollowerHandler(db))))
+	router.HandleFunc("GET /api/users/me/follow-requests", Authenticated(db, WithScope(services.ScopeFollowsRead, ListFollowRequestsHandler(db))))
+	router.HandleFunc("PUT /api/users/me/follow-requests/{username}", Authenticated(db, WithScope(services.ScopeFollowsWrite, AnswerFollowRequestHandler(db, "accept"))))
+	router.HandleFunc("DELETE /api/users/me/follow-requests/{username}", Authenticated(db, WithScope(services.ScopeFollowsWrite, AnswerFollowRequestHandler(db, "reject"))))
+}
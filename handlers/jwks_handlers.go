@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"encoding/json"
+	"natter-chat-go/services"
+	"net/http"
+)
+
+// publish the public signing keys so other services can verify our tokens
+func JWKSHandler(ring *services.KeyRing) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(ring.JWKS())
+	}
+}
+
+func ConfigureJWKSRoutes(router *http.ServeMux, ring *services.KeyRing) {
+	router.HandleFunc("GET /.well-known/jwks.json", JWKSHandler(ring))
+}
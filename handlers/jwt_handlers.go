@@ -3,60 +3,159 @@ package handlers
 import (
 	"database/sql"
 	"errors"
+	"log"
 	"natter-chat-go/models"
+	"natter-chat-go/services"
 	"net/http"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
+const (
+	tokenCookieName   = "token"
+	refreshCookieName = "refresh_token"
+	// loginChallengeCookieName carries the two-factor challenge of logins
+	// that end in a redirect, like those through an identity provider
+	loginChallengeCookieName = "login_challenge"
+)
+
 func GetTokenFromCookies(r *http.Request) (string, error) {
+	return getCookieValue(r, tokenCookieName)
+}
+
+func getCookieValue(r *http.Request, name string) (string, error) {
 	cookies := r.Cookies()
 	for _, cookie := range cookies {
-		if cookie.Name == "token" {
+		if cookie.Name == name {
 			return cookie.Value, nil
 		}
 	}
 
-	return "", errors.New("cookie token not found")
+	return "", errors.New("cookie " + name + " not found")
 }
 
-func ExtractUserFromToken(db *sql.DB, r *http.Request) (models.User, error) {
-	tokenString, err := GetTokenFromCookies(r)
+// set the access and refresh token cookies, along with a fresh CSRF token
+func setAuthCookies(w http.ResponseWriter, tokens *models.TokenPair) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookieName,
+		Value:    tokens.AccessToken,
+		Expires:  time.Unix(tokens.AccessExpiresAt, 0),
+		HttpOnly: httpConfig.CookieHTTPOnly,
+		Secure:   httpConfig.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
 
-	if err != nil {
-		return models.User{}, err
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    tokens.RefreshToken,
+		Expires:  time.Unix(tokens.RefreshExpiresAt, 0),
+		HttpOnly: true,
+		Secure:   httpConfig.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/api/auth",
+	})
+
+	if _, err := setCSRFCookie(w, time.Unix(tokens.RefreshExpiresAt, 0)); err != nil {
+		log.Printf("issuing CSRF token: %v", err)
 	}
+}
+
+func setLoginChallengeCookie(w http.ResponseWriter, challenge *models.TwoFactorChallenge) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookieName,
+		Value:    challenge.Challenge,
+		Expires:  time.Unix(challenge.ExpiresAt, 0),
+		HttpOnly: true,
+		Secure:   httpConfig.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/api/auth/login/2fa",
+	})
+}
+
+func clearLoginChallengeCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookieName,
+		Value:    "",
+		Expires:  time.Now().AddDate(0, 0, -1),
+		HttpOnly: true,
+		Secure:   httpConfig.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/api/auth/login/2fa",
+	})
+}
+
+func clearAuthCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookieName,
+		Value:    "",
+		Expires:  time.Now().AddDate(0, 0, -1),
+		HttpOnly: httpConfig.CookieHTTPOnly,
+		Secure:   httpConfig.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    "",
+		Expires:  time.Now().AddDate(0, 0, -1),
+		HttpOnly: true,
+		Secure:   httpConfig.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/api/auth",
+	})
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte("natter-secret-key"), nil
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    "",
+		Expires:  time.Now().AddDate(0, 0, -1),
+		HttpOnly: false,
+		Secure:   httpConfig.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
 	})
+}
 
+func parseTokenClaims(r *http.Request) (jwt.MapClaims, error) {
+	tokenString, err := getRequestToken(r)
 	if err != nil {
-		return models.User{}, err
+		return nil, err
 	}
 
-	if !token.Valid {
-		return models.User{}, jwt.ErrSignatureInvalid
-	}
+	return services.ParseJWT(tokenString)
+}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return models.User{}, err
+func extractSessionIDFromToken(r *http.Request) (string, error) {
+	claims, err := parseTokenClaims(r)
+	if err != nil {
+		return "", err
 	}
 
-	email, ok := claims["email"].(string)
+	sessionID, ok := claims["sid"].(string)
 	if !ok {
-		return models.User{}, err
+		return "", errors.New("token has no session")
 	}
 
-	var user models.User
-	err = db.QueryRow("SELECT id, username, email FROM users WHERE email = ?", email).Scan(&user.ID, &user.Username, &user.Email)
-	if err != nil {
-		if err == sql.ErrNoRows {
+	return sessionID, nil
+}
+
+// ExtractUserFromToken returns the caller, reusing the principal resolved by
+// the auth middleware when there is one
+func ExtractUserFromToken(db *sql.DB, r *http.Request) (models.User, error) {
+	principal, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		var err error
+		principal, err = resolvePrincipal(db, r)
+		if err != nil {
 			return models.User{}, err
 		}
-		return models.User{}, err
 	}
 
-	return user, nil
+	return models.User{
+		ID:       principal.UserID,
+		Username: principal.Username,
+		Email:    principal.Email,
+	}, nil
 }
@@ -18,13 +18,19 @@ func GetLikedPostsByUserHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		posts, err := services.GetLikedPostsDetailsByUserID(db, userID)
+		page, err := parsePageRequest(r)
 		if err != nil {
-			http.Error(w, "Error fetching liked posts: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		json.NewEncoder(w).Encode(posts)
+		posts, info, err := services.GetLikedPostsDetailsByUserID(db, viewerID(r), userID, page)
+		if err != nil {
+			writeServiceError(w, err, "Error fetching liked posts: ")
+			return
+		}
+
+		writePage(w, r, posts, info)
 	}
 }
 
@@ -39,9 +45,9 @@ func GetPostLikesByPostIDHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		likes, err := services.GetPostLikes(db, postID)
+		likes, err := services.GetVisiblePostLikes(db, viewerID(r), postID)
 		if err != nil {
-			http.Error(w, "Error fetching all likes: "+err.Error(), http.StatusInternalServerError)
+			writeServiceError(w, err, "Error fetching all likes: ")
 			return
 		}
 
@@ -60,15 +66,10 @@ func ModifyLikeHandler(db *sql.DB, action string) http.HandlerFunc {
 			return
 		}
 
-		user, err := ExtractUserFromToken(db, r)
-		if err != nil {
-			http.Error(w, "Error extracting user from token: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		err = services.ModifyPostLike(db, &user.ID, &postID, action)
+		principal, _ := PrincipalFromContext(r.Context())
+		err = services.ModifyPostLike(db, &principal.UserID, &postID, action)
 		if err != nil {
-			http.Error(w, "Error modifying post like: "+err.Error(), http.StatusInternalServerError)
+			writeServiceError(w, err, "Error modifying post like: ")
 			return
 		}
 
@@ -77,8 +78,8 @@ func ModifyLikeHandler(db *sql.DB, action string) http.HandlerFunc {
 }
 
 func ConfigureLikesRoutes(router *http.ServeMux, db *sql.DB) {
-	router.HandleFunc("GET /api/likes/by-user/{userID}", GetLikedPostsByUserHandler(db))
-	router.HandleFunc("GET /api/likes/{postID}", GetPostLikesByPostIDHandler(db))
-	router.HandleFunc("PUT /api/likes/{postID}/like", ModifyLikeHandler(db, "like"))
-	router.HandleFunc("PUT /api/likes/{postID}/dislike", ModifyLikeHandler(db, "dislike"))
+	router.HandleFunc("GET /api/likes/by-user/{userID}", Public(db, WithScope(services.ScopeLikesRead, GetLikedPostsByUserHandler(db))))
+	router.HandleFunc("GET /api/likes/{postID}", Public(db, WithScope(services.ScopeLikesRead, GetPostLikesByPostIDHandler(db))))
+	router.HandleFunc("PUT /api/likes/{postID}/like", Authenticated(db, WithScope(services.ScopeLikesWrite, ModifyLikeHandler(db, "like"))))
+	router.HandleFunc("PUT /api/likes/{postID}/dislike", Authenticated(db, WithScope(services.ScopeLikesWrite, ModifyLikeHandler(db, "dislike"))))
 }
@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"natter-chat-go/models"
+	"natter-chat-go/services"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Principal is the authenticated caller of a request. It comes either from
+// a browser session or from a personal access token, in which case Scopes
+// limits what it can do and it carries no roles.
+type Principal struct {
+	UserID        int
+	Username      string
+	Email         string
+	SessionID     string
+	APITokenID    int
+	Scopes        []string
+	EmailVerified bool
+	Roles         []string
+	Permissions   []string
+	// ImpersonatorID is the admin behind an impersonation session
+	ImpersonatorID int
+	ReadOnly       bool
+}
+
+// HasScope always holds for sessions, tokens need the scope granted
+func (p *Principal) HasScope(scope string) bool {
+	if p.APITokenID == 0 {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) HasRole(role string) bool {
+	return p.Actor().HasRole(role)
+}
+
+func (p *Principal) HasPermission(permission string) bool {
+	return p.Actor().HasPermission(permission)
+}
+
+// Actor converts the principal for the service layer
+func (p *Principal) Actor() models.Actor {
+	return models.Actor{UserID: p.UserID, Roles: p.Roles, Permissions: p.Permissions}
+}
+
+type contextKey int
+
+const principalKey contextKey = iota
+
+var errNoCredentials = errors.New("no credentials")
+
+// PrincipalFromContext returns the caller resolved by the auth middleware
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey).(*Principal)
+	return principal, ok
+}
+
+// the bearer header wins over the cookie so scripts can't be confused by a
+// stale browser session
+func getRequestToken(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, found := strings.Cut(header, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", errors.New("malformed authorization header")
+		}
+		return token, nil
+	}
+
+	token, err := GetTokenFromCookies(r)
+	if err != nil {
+		return "", errNoCredentials
+	}
+	return token, nil
+}
+
+func resolvePrincipal(db *sql.DB, r *http.Request) (*Principal, error) {
+	tokenString, err := getRequestToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(tokenString, services.APITokenPrefix) {
+		return resolveAPITokenPrincipal(db, tokenString)
+	}
+
+	claims, err := services.ParseJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	// tokens issued before sessions existed carry no sid and are rejected.
+	// The user comes from the session, so an email change doesn't break it.
+	sessionID, ok := claims["sid"].(string)
+	if !ok {
+		return nil, errors.New("token has no session")
+	}
+
+	session, err := services.ValidateSession(db, sessionID, clientIP(r))
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := services.GetUserByID(db, session.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := services.GetUserRoles(db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := services.GetUserPermissions(db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Principal{
+		UserID:        user.ID,
+		Username:      user.Username,
+		Email:         user.Email,
+		SessionID:     sessionID,
+		EmailVerified: user.EmailVerified,
+		Roles:         roles,
+		Permissions:   permissions,
+
+		ImpersonatorID: session.ImpersonatorID,
+		ReadOnly:       session.ReadOnly,
+	}, nil
+}
+
+func resolveAPITokenPrincipal(db *sql.DB, token string) (*Principal, error) {
+	user, tokenID, scopes, err := services.AuthenticateAPIToken(db, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Principal{
+		UserID:        user.ID,
+		Username:      user.Username,
+		Email:         user.Email,
+		APITokenID:    tokenID,
+		Scopes:        scopes,
+		EmailVerified: user.EmailVerified,
+	}, nil
+}
+
+// clientIP is the address of the direct peer. Forwarded headers are ignored
+// since anyone can set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func clientInfo(r *http.Request) models.ClientInfo {
+	return models.ClientInfo{UserAgent: r.UserAgent(), IP: clientIP(r)}
+}
+
+func withPrincipal(r *http.Request, principal *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey, principal))
+}
+
+// Public routes work anonymously but still see the caller when credentials
+// are valid
+func Public(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if principal, err := resolvePrincipal(db, r); err == nil {
+			if !guardImpersonation(db, w, r, principal) {
+				return
+			}
+			r = withPrincipal(r, principal)
+		}
+		next(w, r)
+	}
+}
+
+// Authenticated routes reject requests without a valid session
+func Authenticated(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := resolvePrincipal(db, r)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !guardImpersonation(db, w, r, principal) {
+			return
+		}
+		next(w, withPrincipal(r, principal))
+	}
+}
+
+// guardImpersonation audits every request made under impersonation and turns
+// away writes from read-only impersonation sessions
+func guardImpersonation(db *sql.DB, w http.ResponseWriter, r *http.Request, principal *Principal) bool {
+	if principal.ImpersonatorID == 0 {
+		return true
+	}
+
+	event := models.AuditEvent{
+		Event:   services.AuditImpersonationRequest,
+		UserID:  principal.UserID,
+		ActorID: principal.ImpersonatorID,
+		IP:      clientIP(r),
+		Detail:  r.Method + " " + r.URL.Path,
+	}
+
+	readOnlyMethod := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+	if principal.ReadOnly && !readOnlyMethod {
+		event.Event = services.AuditImpersonationBlocked
+		services.RecordAuditEvent(db, event)
+		writeJSONError(w, http.StatusForbidden, "impersonation_read_only", "Read-only impersonation session, changes are not allowed")
+		return false
+	}
+
+	services.RecordAuditEvent(db, event)
+	return true
+}
+
+// Impersonating routes only accept impersonation sessions. Writes are let
+// through so a read-only session can still be ended.
+func Impersonating(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := resolvePrincipal(db, r)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if principal.ImpersonatorID == 0 {
+			http.Error(w, "Forbidden: not an impersonation session", http.StatusForbidden)
+			return
+		}
+		next(w, withPrincipal(r, principal))
+	}
+}
+
+// WithRole routes additionally require the caller to hold one of the roles
+func WithRole(db *sql.DB, roles []string, next http.HandlerFunc) http.HandlerFunc {
+	return Authenticated(db, func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := PrincipalFromContext(r.Context())
+		for _, role := range roles {
+			if principal.HasRole(role) {
+				next(w, r)
+				return
+			}
+		}
+		http.Error(w, "Forbidden: missing required role", http.StatusForbidden)
+	})
+}
+
+// WithPermission routes require the caller to be granted the permission
+// through one of their roles
+func WithPermission(db *sql.DB, permission string, next http.HandlerFunc) http.HandlerFunc {
+	return Authenticated(db, func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := PrincipalFromContext(r.Context())
+		if !principal.HasPermission(permission) {
+			http.Error(w, "Forbidden: missing permission "+permission, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// Verified routes are authenticated and, when the configuration requires it,
+// closed to accounts that have not verified their email yet
+func Verified(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return Authenticated(db, func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := PrincipalFromContext(r.Context())
+		if services.EmailVerificationRequired() && !principal.EmailVerified {
+			writeJSONError(w, http.StatusForbidden, "email_not_verified", "verify your email before posting")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// Interactive routes manage the account itself and only accept a browser
+// session, never a personal access token or an impersonating admin
+func Interactive(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return Authenticated(db, func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := PrincipalFromContext(r.Context())
+		if principal.APITokenID != 0 {
+			http.Error(w, "Forbidden: not available to api tokens", http.StatusForbidden)
+			return
+		}
+		if principal.ImpersonatorID != 0 {
+			http.Error(w, "Forbidden: not available while impersonating", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// WithScope rejects api tokens that were not granted the scope. Anonymous
+// callers pass through so it can wrap public routes too.
+func WithScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if principal, ok := PrincipalFromContext(r.Context()); ok && !principal.HasScope(scope) {
+			http.Error(w, "Forbidden: token is missing scope "+scope, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"natter-chat-go/services"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const oidcStateCookieName = "oidc_state"
+
+// redirect the browser to the identity provider
+func OIDCLogin(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authURL, state, err := services.StartOIDCLogin(db, r.PathValue("provider"))
+		if err != nil {
+			if err == services.ErrUnknownOIDCProvider {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Error starting login: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		setOIDCStateCookie(w, state)
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// send a signed in user without a password back to the identity provider,
+// so they can confirm changes to their account
+func OIDCReauthenticate(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := PrincipalFromContext(r.Context())
+		authURL, state, err := services.StartOIDCReauthentication(db, r.PathValue("provider"), principal.SessionID)
+		if err != nil {
+			if err == services.ErrUnknownOIDCProvider {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Error starting reauthentication: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		setOIDCStateCookie(w, state)
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// binds the callback to the browser that started the flow
+func setOIDCStateCookie(w http.ResponseWriter, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+		Secure:   httpConfig.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/api/auth/oidc",
+	})
+}
+
+// the provider sends the browser back here with the authorization code, on
+// success the same cookies as a password login are set
+func OIDCCallback(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookieName,
+			Value:    "",
+			Expires:  time.Now().AddDate(0, 0, -1),
+			HttpOnly: true,
+			Secure:   httpConfig.CookieSecure,
+			SameSite: http.SameSiteLaxMode,
+			Path:     "/api/auth/oidc",
+		})
+
+		query := r.URL.Query()
+		if providerErr := query.Get("error"); providerErr != "" {
+			redirectToApp(w, r, "/login", url.Values{"error": {providerErr}})
+			return
+		}
+
+		state := query.Get("state")
+		cookieState, err := getCookieValue(r, oidcStateCookieName)
+		if err != nil || state == "" || cookieState != state {
+			redirectToApp(w, r, "/login", url.Values{"error": {"invalid_state"}})
+			return
+		}
+
+		result, err := services.CompleteOIDCLogin(db, r.PathValue("provider"), state, query.Get("code"), clientInfo(r))
+		if err != nil {
+			code := "login_failed"
+			switch err {
+			case services.ErrUnknownOIDCProvider, services.ErrInvalidOIDCState:
+				code = "invalid_state"
+			case services.ErrOIDCEmailUnverified:
+				code = "email_unverified"
+			case services.ErrOIDCWrongIdentity:
+				code = "wrong_identity"
+			default:
+				log.Printf("oidc login with %s: %v", r.PathValue("provider"), err)
+			}
+			redirectToApp(w, r, "/login", url.Values{"error": {code}})
+			return
+		}
+
+		if result.Reauthenticated {
+			redirectToApp(w, r, "/settings/account", url.Values{"reauthenticated": {"true"}})
+			return
+		}
+
+		// the challenge stays out of the url, where history, logs and
+		// referers would keep it
+		if result.Challenge != nil {
+			setLoginChallengeCookie(w, result.Challenge)
+			redirectToApp(w, r, "/login/2fa", nil)
+			return
+		}
+
+		setAuthCookies(w, result.Tokens)
+		redirectToApp(w, r, "/", nil)
+	}
+}
+
+func redirectToApp(w http.ResponseWriter, r *http.Request, path string, params url.Values) {
+	target := services.AppBaseURL() + path
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func ConfigureOIDCRoutes(muxRouter *http.ServeMux, db *sql.DB) {
+	muxRouter.HandleFunc("GET /api/auth/oidc/{provider}/login", OIDCLogin(db))
+	muxRouter.HandleFunc("GET /api/auth/oidc/{provider}/callback", OIDCCallback(db))
+	muxRouter.HandleFunc("GET /api/auth/oidc/{provider}/reauthenticate", Interactive(db, OIDCReauthenticate(db)))
+}
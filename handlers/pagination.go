@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"natter-chat-go/models"
+	"natter-chat-go/services"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// parsePageRequest reads the cursor and limit query parameters
+func parsePageRequest(r *http.Request) (services.PageRequest, error) {
+	query := r.URL.Query()
+	page := services.PageRequest{Limit: services.DefaultPageLimit}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > services.MaxPageLimit {
+			return page, fmt.Errorf("limit must be between 1 and %d", services.MaxPageLimit)
+		}
+		page.Limit = limit
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := services.DecodeCursor(value)
+		if err != nil {
+			return page, err
+		}
+		page.Cursor = cursor
+	}
+
+	return page, nil
+}
+
+// writePage sends a list in the pagination envelope, with the neighbouring
+// pages also linked from the Link header
+func writePage(w http.ResponseWriter, r *http.Request, data interface{}, info models.PageInfo) {
+	links := []string{}
+	for _, link := range []struct{ cursor, rel string }{{info.NextCursor, "next"}, {info.PrevCursor, "prev"}} {
+		if link.cursor == "" {
+			continue
+		}
+
+		target := *r.URL
+		query := target.Query()
+		query.Set("cursor", link.cursor)
+		query.Set("limit", strconv.Itoa(info.Limit))
+		target.RawQuery = query.Encode()
+		links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, target.RequestURI(), link.rel))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	json.NewEncoder(w).Encode(models.PageResponse{Data: data, Pagination: info})
+}
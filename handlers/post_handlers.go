@@ -6,6 +6,7 @@ import (
 	"natter-chat-go/models"
 	"natter-chat-go/services"
 	"net/http"
+	"net/url"
 	"strconv"
 )
 
@@ -13,13 +14,19 @@ import (
 func GetPostsHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		posts, err := services.GetPosts(db)
+		page, err := parsePageRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		posts, info, err := services.GetPosts(db, viewerID(r), page)
 		if err != nil {
 			http.Error(w, "Error fetching all posts: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		json.NewEncoder(w).Encode(posts)
+		writePage(w, r, posts, info)
 	}
 }
 
@@ -33,9 +40,9 @@ func GetPostByIDHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		post, err := services.GetPostByID(db, id)
+		post, err := services.GetVisiblePost(db, viewerID(r), id)
 		if err != nil {
-			http.Error(w, "Error fetching post by ID: "+err.Error(), http.StatusInternalServerError)
+			writeServiceError(w, err, "Error fetching post by ID: ")
 			return
 		}
 
@@ -48,20 +55,36 @@ func GetPostsByUsernameHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		username := r.PathValue("username")
+		page, err := parsePageRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		user, err := services.GetUserByUsername(db, username)
+		if err == sql.ErrNoRows {
+			// the account may have been renamed
+			if current, err := services.ResolveOldUsername(db, username); err == nil {
+				target := "/api/posts/user/" + url.PathEscape(current)
+				if r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, target, http.StatusMovedPermanently)
+				return
+			}
+		}
 		if err != nil {
 			http.Error(w, "Error fetching user by username: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		posts, err := services.GetPostsByUserID(db, user.ID)
+		posts, info, err := services.GetPostsByUserID(db, viewerID(r), user.ID, page)
 		if err != nil {
-			http.Error(w, "Error fetching posts by user ID: "+err.Error(), http.StatusInternalServerError)
+			writeServiceError(w, err, "Error fetching posts by user ID: ")
 			return
 		}
 
-		json.NewEncoder(w).Encode(posts)
+		writePage(w, r, posts, info)
 	}
 
 }
@@ -78,18 +101,12 @@ func CreatePostHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		user, err := ExtractUserFromToken(db, r)
-
-		if err != nil {
-			http.Error(w, "User not found: "+err.Error(), http.StatusUnauthorized)
-			return
-		}
-
-		post.UserID = user.ID
+		principal, _ := PrincipalFromContext(r.Context())
+		post.UserID = principal.UserID
 
 		createdPost, err := services.CreatePost(db, post)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeServiceError(w, err, "Error creating post: ")
 			return
 		}
 
@@ -116,9 +133,10 @@ func UpdatePostHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		updatedPost, err := services.UpdatePost(db, post, postID)
+		principal, _ := PrincipalFromContext(r.Context())
+		updatedPost, err := services.UpdatePost(db, principal.Actor(), post, postID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeServiceError(w, err, "Error updating post: ")
 			return
 		}
 
@@ -137,9 +155,10 @@ func DeletePostHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		_, err = services.DeletePost(db, id)
+		principal, _ := PrincipalFromContext(r.Context())
+		_, err = services.DeletePost(db, principal.Actor(), id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeServiceError(w, err, "Error deleting post: ")
 			return
 		}
 
@@ -149,10 +168,10 @@ func DeletePostHandler(db *sql.DB) http.HandlerFunc {
 
 // configure post routes
 func ConfigurePostRoutes(router *http.ServeMux, db *sql.DB) {
-	router.HandleFunc("GET /api/posts", GetPostsHandler(db))
-	router.HandleFunc("GET /api/post/{postID}", GetPostByIDHandler(db))
-	router.HandleFunc("GET /api/posts/user/{username}", GetPostsByUsernameHandler(db))
-	router.HandleFunc("POST /api/posts", CreatePostHandler(db))
-	router.HandleFunc("PUT /api/posts/{postID}", UpdatePostHandler(db))
-	router.HandleFunc("DELETE /api/posts/{postID}", DeletePostHandler(db))
+	router.HandleFunc("GET /api/posts", Public(db, WithScope(services.ScopePostsRead, GetPostsHandler(db))))
+	router.HandleFunc("GET /api/post/{postID}", Public(db, WithScope(services.ScopePostsRead, GetPostByIDHandler(db))))
+	router.HandleFunc("GET /api/posts/user/{username}", Public(db, WithScope(services.ScopePostsRead, GetPostsByUsernameHandler(db))))
+	router.HandleFunc("POST /api/posts", Verified(db, WithScope(services.ScopePostsWrite, CreatePostHandler(db))))
+	router.HandleFunc("PUT /api/posts/{postID}", Authenticated(db, WithScope(services.ScopePostsWrite, UpdatePostHandler(db))))
+	router.HandleFunc("DELETE /api/posts/{postID}", Authenticated(db, WithScope(services.ScopePostsWrite, DeletePostHandler(db))))
 }
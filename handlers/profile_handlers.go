@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"natter-chat-go/models"
+	"natter-chat-go/services"
+	"net/http"
+	"net/url"
+)
+
+func GetMyProfileHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		profile, err := services.GetProfileByID(db, principal.UserID, principal.UserID)
+		if err != nil {
+			writeServiceError(w, err, "Error fetching profile: ")
+			return
+		}
+
+		json.NewEncoder(w).Encode(profile)
+	}
+}
+
+func UpdateMyProfileHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		var request models.UpdateProfileRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		profile, err := services.UpdateProfile(db, principal.UserID, request)
+		if err != nil {
+			writeServiceError(w, err, "Error updating profile: ")
+			return
+		}
+
+		json.NewEncoder(w).Encode(profile)
+	}
+}
+
+func GetProfileByUsernameHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		username := r.PathValue("username")
+
+		profile, err := services.GetProfileByUsername(db, viewerID(r), username)
+		if err == sql.ErrNoRows {
+			if current, err := services.ResolveOldUsername(db, username); err == nil {
+				http.Redirect(w, r, "/api/users/"+url.PathEscape(current), http.StatusMovedPermanently)
+				return
+			}
+		}
+		if err != nil {
+			writeServiceError(w, err, "Error fetching profile: ")
+			return
+		}
+
+		json.NewEncoder(w).Encode(profile)
+	}
+}
+
+func ConfigureProfileRoutes(router *http.ServeMux, db *sql.DB) {
+	router.HandleFunc("GET /api/users/me", Authenticated(db, GetMyProfileHandler(db)))
+	router.HandleFunc("PATCH /api/users/me", Interactive(db, UpdateMyProfileHandler(db)))
+	router.HandleFunc("GET /api/users/{username}", Public(db, GetProfileByUsernameHandler(db)))
+}
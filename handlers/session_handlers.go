@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"natter-chat-go/services"
+	"net/http"
+)
+
+func ListSessionsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		sessions, err := services.ListActiveSessions(db, principal.UserID, principal.SessionID)
+		if err != nil {
+			http.Error(w, "Error fetching sessions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(sessions)
+	}
+}
+
+// signs out one device, signing out the current one also clears its cookies
+func RevokeSessionHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+		sessionID := r.PathValue("sessionID")
+
+		if err := services.RevokeUserSession(db, principal.UserID, sessionID); err != nil {
+			writeServiceError(w, err, "Error revoking session: ")
+			return
+		}
+
+		if sessionID == principal.SessionID {
+			clearAuthCookies(w)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// sign out everywhere else
+func RevokeOtherSessionsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		if err := services.RevokeOtherUserSessions(db, principal.UserID, principal.SessionID); err != nil {
+			http.Error(w, "Error revoking sessions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ConfigureSessionRoutes(router *http.ServeMux, db *sql.DB) {
+	router.HandleFunc("GET /api/auth/sessions", Interactive(db, ListSessionsHandler(db)))
+	router.HandleFunc("DELETE /api/auth/sessions", Interactive(db, RevokeOtherSessionsHandler(db)))
+	router.HandleFunc("DELETE /api/auth/sessions/{sessionID}", Interactive(db, RevokeSessionHandler(db)))
+}
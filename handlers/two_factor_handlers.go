@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"natter-chat-go/services"
+	"net/http"
+)
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+func EnrollTOTPHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		enrollment, err := services.EnrollTOTP(db, principal.UserID)
+		if err != nil {
+			if err == services.ErrTOTPAlreadyEnabled {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			http.Error(w, "Error enrolling two-factor: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(enrollment)
+	}
+}
+
+func ConfirmTOTPHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		var body twoFactorCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		recoveryCodes, err := services.ConfirmTOTP(db, principal.UserID, body.Code)
+		if err != nil {
+			switch err {
+			case services.ErrInvalidTwoFactorCode, services.ErrTOTPNotEnrolled:
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			case services.ErrTOTPAlreadyEnabled:
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, "Error confirming two-factor: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		json.NewEncoder(w).Encode(struct {
+			RecoveryCodes []string `json:"recoveryCodes"`
+		}{recoveryCodes})
+	}
+}
+
+func DisableTOTPHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		principal, _ := PrincipalFromContext(r.Context())
+
+		var body twoFactorCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding json request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := services.DisableTOTP(db, principal.UserID, body.Code)
+		if err != nil {
+			switch err {
+			case services.ErrInvalidTwoFactorCode, services.ErrTOTPNotEnrolled:
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			default:
+				http.Error(w, "Error disabling two-factor: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ConfigureTwoFactorRoutes(router *http.ServeMux, db *sql.DB) {
+	router.HandleFunc("POST /api/auth/2fa/totp", Interactive(db, EnrollTOTPHandler(db)))
+	router.HandleFunc("POST /api/auth/2fa/totp/confirm", Interactive(db, ConfirmTOTPHandler(db)))
+	router.HandleFunc("DELETE /api/auth/2fa/totp", Interactive(db, DisableTOTPHandler(db)))
+}
@@ -2,14 +2,44 @@ package main
 
 import (
 	"fmt"
+	"natter-chat-go/config"
 	"natter-chat-go/db"
 	"natter-chat-go/handlers"
+	"natter-chat-go/mailer"
+	"natter-chat-go/services"
 	"net/http"
 
 	"github.com/go-sql-driver/mysql"
 )
 
 func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		panic(err)
+	}
+
+	keyRing, err := services.NewKeyRing(cfg.JWT)
+	if err != nil {
+		panic(err)
+	}
+	services.SetKeyRing(keyRing)
+	if err := services.SetConfig(cfg); err != nil {
+		panic(err)
+	}
+
+	if cfg.Password.BreachedListFile != "" {
+		if err := services.LoadBreachedPasswords(cfg.Password.BreachedListFile); err != nil {
+			panic(err)
+		}
+	}
+
+	mailSender, err := mailer.New(cfg.Mail)
+	if err != nil {
+		panic(err)
+	}
+	services.SetMailer(mailSender)
+	handlers.SetHTTPConfig(cfg.HTTP)
+
 	db, err := db.NewMySQLStorage(mysql.Config{
 		User:      "cquark",
 		Passwd:    "cquark",
@@ -28,27 +58,41 @@ func main() {
 	mux := http.NewServeMux()
 
 	handlers.ConfigurePostRoutes(mux, db)
+	handlers.ConfigureFeedRoutes(mux, db)
 	handlers.ConfigureAuthRoutes(mux, db)
+	handlers.ConfigureOIDCRoutes(mux, db)
+	handlers.ConfigureSessionRoutes(mux, db)
+	handlers.ConfigureTwoFactorRoutes(mux, db)
+	handlers.ConfigureAPITokenRoutes(mux, db)
+	handlers.ConfigureAccountRoutes(mux, db)
+	handlers.ConfigureProfileRoutes(mux, db)
+	handlers.ConfigureFollowRoutes(mux, db)
+	handlers.ConfigureBlockRoutes(mux, db)
 	handlers.ConfigureLikesRoutes(mux, db)
 	handlers.ConfigureCommentsRoutes(mux, db)
+	handlers.ConfigureAdminRoutes(mux, db)
+	handlers.ConfigureJWKSRoutes(mux, keyRing)
 
-	corsMux := EnableCors(mux)
+	corsMux := EnableCors(handlers.CSRFProtect(mux))
 
 	if err := http.ListenAndServe("localhost:8080", corsMux); err != nil {
 		fmt.Println(err.Error())
 	}
 }
 
-// cors handler
+// cors handler, only origins on the allowlist get credentialed access
 func EnableCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+
 		origin := r.Header.Get("Origin")
-		if origin != "" {
+		if origin != "" && handlers.OriginAllowed(origin) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CSRF-Token")
+			w.Header().Set("Access-Control-Expose-Headers", "X-CSRF-Token")
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
 		}
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
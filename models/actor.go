@@ -0,0 +1,26 @@
+package models
+
+// Actor is the user performing an action, as seen by the service layer
+type Actor struct {
+	UserID      int
+	Roles       []string
+	Permissions []string
+}
+
+func (a Actor) HasRole(role string) bool {
+	for _, r := range a.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (a Actor) HasPermission(permission string) bool {
+	for _, p := range a.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
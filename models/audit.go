@@ -0,0 +1,11 @@
+package models
+
+type AuditEvent struct {
+	ID        int    `json:"id"`
+	Event     string `json:"event"`
+	UserID    int    `json:"userId,omitempty"`
+	ActorID   int    `json:"actorId,omitempty"`
+	IP        string `json:"ip"`
+	Detail    string `json:"detail"`
+	CreatedAt string `json:"createdAt"`
+}
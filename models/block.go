@@ -0,0 +1,10 @@
+package models
+
+// RestrictedUser is an entry of the blocked or muted users list
+type RestrictedUser struct {
+	ID          int    `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Photo       string `json:"photoUrl"`
+	Since       string `json:"since"`
+}
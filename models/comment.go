@@ -6,6 +6,7 @@ type Comment struct {
 	CreatedAt string `json:"createdAt"`
 	UserID    int    `json:"userId"`
 	PostID    int    `json:"postId"`
+	ParentID  *int   `json:"parentId"`
 }
 
 type CommentWithUserResponse struct {
@@ -14,8 +15,17 @@ type CommentWithUserResponse struct {
 	CreatedAt string `json:"createdAt"`
 	UserID    int    `json:"userId"`
 	PostID    int    `json:"postId"`
+	ParentID  *int   `json:"parentId"`
 	Username  string `json:"username"`
 	UserPhoto string `json:"userPhoto"`
+	// Deleted comments stay as a "[deleted]" placeholder while they have
+	// replies, without their author
+	Deleted    bool `json:"deleted"`
+	ReplyCount int  `json:"replyCount"`
+	// Replies holds the first page of direct replies when they were loaded,
+	// RepliesNextCursor continues it on the replies endpoint
+	Replies           []*CommentWithUserResponse `json:"replies,omitempty"`
+	RepliesNextCursor string                     `json:"repliesNextCursor,omitempty"`
 }
 
 type CreateCommentRequest struct {
@@ -23,4 +33,6 @@ type CreateCommentRequest struct {
 	CreatedAt string `json:"createdAt"`
 	UserID    int    `json:"userId"`
 	PostID    int    `json:"postId"`
+	// ParentID makes the comment a reply to another comment on the same post
+	ParentID *int `json:"parentId"`
 }
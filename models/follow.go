@@ -0,0 +1,17 @@
+package models
+
+// FollowUser is an entry of a follower, following or follow request list
+type FollowUser struct {
+	// FollowID orders the list, it isn't part of the response
+	FollowID    int    `json:"-"`
+	ID          int    `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Photo       string `json:"photoUrl"`
+	Since       string `json:"since"`
+}
+
+// FollowStatus is where the caller stands with another account
+type FollowStatus struct {
+	Status string `json:"status"`
+}
@@ -0,0 +1,15 @@
+package models
+
+// PageInfo describes where a page sits in a list. The cursors are opaque,
+// an empty one means there is nothing more in that direction.
+type PageInfo struct {
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"nextCursor,omitempty"`
+	PrevCursor string `json:"prevCursor,omitempty"`
+}
+
+// PageResponse is the envelope every paginated list is returned in
+type PageResponse struct {
+	Data       interface{} `json:"data"`
+	Pagination PageInfo    `json:"pagination"`
+}
@@ -6,6 +6,7 @@ type Post struct {
 	Content      string      `json:"content"`
 	CreatedAt    string      `json:"createdAt"`
 	UserID       int         `json:"userId"`
+	Visibility   string      `json:"visibility"`
 	User         UserProfile `json:"user"`
 	PhotoURLs    []string    `json:"photoUrls"`
 	LikedBy      []int       `json:"likedBy"`
@@ -18,4 +19,7 @@ type CreatePostRequest struct {
 	CreatedAt string   `json:"createdAt"`
 	UserID    int      `json:"userId"`
 	PhotoURLs []string `json:"photoUrls"`
+	// Visibility is public, followers, private or unlisted. Public when
+	// creating and unchanged when updating if left empty.
+	Visibility string `json:"visibility"`
 }
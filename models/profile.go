@@ -0,0 +1,30 @@
+package models
+
+type Profile struct {
+	ID          int    `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Bio         string `json:"bio"`
+	Location    string `json:"location"`
+	Website     string `json:"website"`
+	Photo       string `json:"photoUrl"`
+	BannerURL   string `json:"bannerUrl"`
+	JoinedAt    string `json:"joinedAt"`
+	PostCount   int    `json:"postCount"`
+
+	FollowerCount  int  `json:"followerCount"`
+	FollowingCount int  `json:"followingCount"`
+	IsPrivate      bool `json:"isPrivate"`
+}
+
+// UpdateProfileRequest only changes the fields that are present
+type UpdateProfileRequest struct {
+	Username    *string `json:"username"`
+	DisplayName *string `json:"displayName"`
+	Bio         *string `json:"bio"`
+	Location    *string `json:"location"`
+	Website     *string `json:"website"`
+	Photo       *string `json:"photoUrl"`
+	BannerURL   *string `json:"bannerUrl"`
+	IsPrivate   *bool   `json:"isPrivate"`
+}
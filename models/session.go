@@ -0,0 +1,32 @@
+package models
+
+type Session struct {
+	ID        string `json:"id"`
+	UserID    int    `json:"userId"`
+	CreatedAt string `json:"createdAt"`
+	RevokedAt string `json:"revokedAt,omitempty"`
+}
+
+// ClientInfo describes the device a session was started from
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+// ActiveSession is a session as the user sees it in their device list
+type ActiveSession struct {
+	ID         string `json:"id"`
+	UserAgent  string `json:"userAgent"`
+	IP         string `json:"ip"`
+	CreatedAt  string `json:"createdAt"`
+	LastSeenAt string `json:"lastSeenAt"`
+	Current    bool   `json:"current"`
+}
+
+type TokenPair struct {
+	AccessToken      string `json:"accessToken"`
+	RefreshToken     string `json:"refreshToken"`
+	SessionID        string `json:"sessionId"`
+	AccessExpiresAt  int64  `json:"accessExpiresAt"`
+	RefreshExpiresAt int64  `json:"refreshExpiresAt"`
+}
@@ -0,0 +1,22 @@
+package models
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauthUri"`
+}
+
+type TwoFactorChallenge struct {
+	Challenge string `json:"challenge"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// LoginResult holds either an established session or, when the account has
+// two-factor enabled, the challenge that must be completed first
+type LoginResult struct {
+	User      *User
+	Tokens    *TokenPair
+	Challenge *TwoFactorChallenge
+	// Reauthenticated is set instead when an identity provider confirmed
+	// the user of an existing session
+	Reauthenticated bool
+}
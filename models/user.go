@@ -1,12 +1,14 @@
 package models
 
 type User struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Password string `json:"password,omitempty"`
-	Photo    string `json:"photoUrl"`
-	Token    string `json:"token,omitempty"`
+	ID            int      `json:"id"`
+	Username      string   `json:"username"`
+	Email         string   `json:"email"`
+	Password      string   `json:"password,omitempty"`
+	Photo         string   `json:"photoUrl"`
+	Token         string   `json:"token,omitempty"`
+	Roles         []string `json:"roles,omitempty"`
+	EmailVerified bool     `json:"emailVerified"`
 }
 
 type UserProfile struct {
@@ -0,0 +1,224 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"natter-chat-go/mailer"
+	"strings"
+	"time"
+)
+
+// how long a reauthentication through the identity provider stands in for
+// the password of an account that has none
+const reauthenticationWindow = 5 * time.Minute
+
+var (
+	ErrWrongPassword            = errors.New("current password is incorrect")
+	ErrReauthenticationRequired = errors.New("this account has no password, sign in again with your identity provider to confirm")
+	ErrEmailTaken               = errors.New("email already exists")
+	ErrInvalidEmail             = errors.New("invalid email")
+)
+
+// checkCurrentPassword guards account changes behind the password. Accounts
+// created through an identity provider have none, for them the session has
+// to be reauthenticated with the provider shortly before.
+func checkCurrentPassword(db *sql.DB, userID int, sessionID, password string) error {
+	var hashedPassword string
+	if err := db.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&hashedPassword); err != nil {
+		return err
+	}
+
+	if hashedPassword == "" {
+		var reauthenticatedAt sql.NullTime
+		query := "SELECT reauthenticated_at FROM sessions WHERE id = ? AND user_id = ? AND revoked_at IS NULL"
+		err := db.QueryRow(query, sessionID, userID).Scan(&reauthenticatedAt)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if !reauthenticatedAt.Valid || time.Since(reauthenticatedAt.Time) > reauthenticationWindow {
+			return ErrReauthenticationRequired
+		}
+		return nil
+	}
+
+	if err := verifyPassword(password, hashedPassword); err != nil {
+		return ErrWrongPassword
+	}
+
+	return nil
+}
+
+// ChangePassword sets a new password and signs out every other session
+func ChangePassword(db *sql.DB, userID int, sessionID, currentPassword, newPassword string) error {
+	if err := checkCurrentPassword(db, userID, sessionID, currentPassword); err != nil {
+		return err
+	}
+
+	user, err := GetUserByID(db, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := ValidatePassword(newPassword, user.Username, user.Email); err != nil {
+		return err
+	}
+
+	hashedPassword, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("UPDATE users SET password = ? WHERE id = ?", hashedPassword, userID); err != nil {
+		return err
+	}
+
+	return RevokeOtherUserSessions(db, userID, sessionID)
+}
+
+// ChangeEmail moves the account to a new address, which has to be verified
+// again. The old address is told about the change.
+func ChangeEmail(db *sql.DB, userID int, sessionID, currentPassword, newEmail string) error {
+	newEmail = strings.TrimSpace(newEmail)
+	if !strings.Contains(newEmail, "@") || len(newEmail) > 255 {
+		return ErrInvalidEmail
+	}
+
+	if err := checkCurrentPassword(db, userID, sessionID, currentPassword); err != nil {
+		return err
+	}
+
+	user, err := GetUserByID(db, userID)
+	if err != nil {
+		return err
+	}
+
+	var existing int
+	err = db.QueryRow("SELECT id FROM users WHERE email = ? AND id <> ?", newEmail, userID).Scan(&existing)
+	if err == nil {
+		return ErrEmailTaken
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	if _, err := db.Exec("UPDATE users SET email = ?, email_verified_at = NULL WHERE id = ?", newEmail, userID); err != nil {
+		return err
+	}
+
+	if err := SendVerificationEmail(db, userID); err != nil {
+		log.Printf("sending verification email to user %d: %v", userID, err)
+	}
+
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Your Natter email was changed",
+		Body:    "The email of your Natter account was changed to " + newEmail + ".\n\nIf you didn't do this, reset your password right away.\n",
+	}
+	if err := mailSender.Send(msg); err != nil {
+		log.Printf("notifying user %d of email change: %v", userID, err)
+	}
+
+	return nil
+}
+
+// DeleteAccount removes the user with everything they created: their posts
+// go the same way as in DeletePost, their likes and comments on other posts
+// are removed too, except comments with replies which stay as placeholders
+func DeleteAccount(db *sql.DB, userID int, sessionID, password string) error {
+	if err := checkCurrentPassword(db, userID, sessionID, password); err != nil {
+		return err
+	}
+
+	postIDs, err := queryInts(db, "SELECT id FROM posts WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, postID := range postIDs {
+		if _, err := deletePostTx(tx, postID); err != nil {
+			return err
+		}
+	}
+
+	if err := detachUserComments(tx, userID); err != nil {
+		return err
+	}
+
+	statements := []string{
+		"DELETE FROM post_likes WHERE user_id = ?",
+		"DELETE FROM home_timeline WHERE user_id = ?",
+		"DELETE FROM blocks WHERE blocker_id = ?",
+		"DELETE FROM blocks WHERE blocked_id = ?",
+		"DELETE FROM mutes WHERE muter_id = ?",
+		"DELETE FROM mutes WHERE muted_id = ?",
+		"DELETE FROM follows WHERE follower_id = ?",
+		"DELETE FROM follows WHERE followee_id = ?",
+		"DELETE FROM refresh_tokens WHERE session_id IN (SELECT id FROM sessions WHERE user_id = ?)",
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM refresh_tokens WHERE session_id IN (SELECT id FROM sessions WHERE impersonator_id = ?)",
+		"DELETE FROM sessions WHERE impersonator_id = ?",
+		"DELETE FROM email_verification_tokens WHERE user_id = ?",
+		"DELETE FROM password_reset_tokens WHERE user_id = ?",
+		"DELETE FROM magic_link_tokens WHERE user_id = ?",
+		"DELETE FROM login_challenges WHERE user_id = ?",
+		"DELETE FROM totp_recovery_codes WHERE user_id = ?",
+		"DELETE FROM user_totp WHERE user_id = ?",
+		"DELETE FROM api_tokens WHERE user_id = ?",
+		"DELETE FROM user_identities WHERE user_id = ?",
+		"DELETE FROM user_roles WHERE user_id = ?",
+		"DELETE FROM username_history WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	}
+	var email string
+	if err := tx.QueryRow("SELECT email FROM users WHERE id = ? FOR UPDATE", userID).Scan(&email); err != nil {
+		return err
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, userID); err != nil {
+			return err
+		}
+	}
+
+	// unlock links and lockouts go by email, left behind they would carry
+	// over to the next account registered with it. Audit events stay as the
+	// record of what happened to the account, login_attempts and
+	// magic_link_requests are rate limits that expire on their own.
+	emailStatements := []string{
+		"DELETE FROM account_unlock_tokens WHERE email = ?",
+		"DELETE FROM login_throttles WHERE email = ?",
+	}
+	for _, statement := range emailStatements {
+		if _, err := tx.Exec(statement, normalizeEmail(email)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func queryInts(db *sql.DB, query string, args ...interface{}) ([]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []int{}
+	for rows.Next() {
+		var value int
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
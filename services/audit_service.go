@@ -0,0 +1,32 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"natter-chat-go/models"
+	"time"
+)
+
+const (
+	AuditLoginThrottled = "login.throttled"
+	AuditLoginLocked    = "login.locked"
+	AuditLoginUnlocked  = "login.unlocked"
+)
+
+// RecordAuditEvent stores a security relevant event. Failing to audit never
+// fails the request, it is only logged.
+func RecordAuditEvent(db *sql.DB, event models.AuditEvent) {
+	query := `
+		INSERT INTO audit_events (event, user_id, actor_id, ip, detail, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+
+	_, err := db.Exec(query, event.Event, nullableID(event.UserID), nullableID(event.ActorID), event.IP, event.Detail, time.Now())
+	if err != nil {
+		log.Printf("recording audit event %s: %v", event.Event, err)
+	}
+}
+
+func nullableID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
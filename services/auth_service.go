@@ -3,16 +3,31 @@ package services
 import (
 	"database/sql"
 	"errors"
+	"log"
 	"natter-chat-go/models"
 	"time"
 
 	"github.com/golang-jwt/jwt"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func Login(db *sql.DB, email, password string) (*models.User, error) {
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+func Login(db *sql.DB, email, password string, client models.ClientInfo) (*models.LoginResult, error) {
+	ip := client.IP
+	throttleKey := normalizeEmail(email)
+	if err := checkLoginAllowed(db, throttleKey, ip); err != nil {
+		return nil, err
+	}
+
 	var user models.User
-	err := db.QueryRow("SELECT id, username, email, password, photo_url FROM users WHERE email = ?", email).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Photo)
+	query := "SELECT id, username, email, password, photo_url, email_verified_at IS NOT NULL FROM users WHERE email = ?"
+	err := db.QueryRow(query, email).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Photo, &user.EmailVerified)
+	if err == sql.ErrNoRows {
+		if err := recordLoginFailure(db, throttleKey, ip); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidCredentials
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -20,19 +35,63 @@ func Login(db *sql.DB, email, password string) (*models.User, error) {
 	// password verification
 	err = verifyPassword(password, user.Password)
 	if err != nil {
-		return nil, err
+		if err := recordLoginFailure(db, throttleKey, ip); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidCredentials
+	}
+
+	// the plain password is only available now, so this is the moment to
+	// move the hash to the current algorithm and parameters
+	if passwordNeedsRehash(user.Password) {
+		rehashPassword(db, user.ID, password, user.Password)
 	}
 
 	// no return password
 	user.Password = ""
-	token, err := CreateJWT(email)
+
+	result, err := completeLogin(db, &user, client)
 	if err != nil {
 		return nil, err
 	}
 
-	user.Token = token
+	// with two-factor the login only succeeds once the second factor does,
+	// until then the failures keep counting
+	if result.Challenge == nil {
+		if err := recordLoginSuccess(db, throttleKey, ip); err != nil {
+			return nil, err
+		}
+	}
 
-	return &user, nil
+	return result, nil
+}
+
+// completeLogin finishes a login after the first factor checked out: with
+// two-factor enabled it only earns a challenge, otherwise a session
+func completeLogin(db *sql.DB, user *models.User, client models.ClientInfo) (*models.LoginResult, error) {
+	twoFactor, err := isTOTPEnabled(db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if twoFactor {
+		challenge, err := createLoginChallenge(db, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		return &models.LoginResult{Challenge: challenge}, nil
+	}
+
+	user.Roles, err = GetUserRoles(db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := CreateSession(db, user, client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.LoginResult{User: user, Tokens: tokens}, nil
 }
 
 func Register(db *sql.DB, register models.Register) (int64, error) {
@@ -44,6 +103,10 @@ func Register(db *sql.DB, register models.Register) (int64, error) {
 		return 0, errors.New("email already exists")
 	}
 
+	if err := ValidatePassword(register.Password, register.Username, register.Email); err != nil {
+		return 0, err
+	}
+
 	hashedPassword, err := hashPassword(register.Password)
 	if err != nil {
 		return 0, err
@@ -54,29 +117,78 @@ func Register(db *sql.DB, register models.Register) (int64, error) {
 		return 0, err
 	}
 
-	return result.LastInsertId()
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	// the account exists even if the email fails, the user can ask for a resend
+	if err := SendVerificationEmail(db, int(userID)); err != nil {
+		log.Printf("sending verification email to user %d: %v", userID, err)
+	}
+
+	return userID, nil
 }
 
+// EmailVerificationRequired reports whether unverified users are restricted
+func EmailVerificationRequired() bool {
+	return appConfig.RequireVerifiedEmail
+}
+
+var errPasswordMismatch = errors.New("password mismatch")
+
+// verifyPassword checks the password with whichever algorithm made the hash
 func verifyPassword(password, hashedPassword string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	for _, hasher := range knownHashers {
+		if !hasher.Handles(hashedPassword) {
+			continue
+		}
+
+		ok, err := hasher.Verify(password, hashedPassword)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errPasswordMismatch
+		}
+		return nil
+	}
+
+	return ErrUnknownHashFormat
 }
 
 func hashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return passwordHasher.Hash(password)
+}
+
+// rehashPassword upgrades a stored hash after a successful login. The old
+// hash in the WHERE clause keeps a concurrent password change from being
+// overwritten.
+func rehashPassword(db *sql.DB, userID int, password, oldHash string) {
+	newHash, err := hashPassword(password)
 	if err != nil {
-		return "", err
+		log.Printf("rehashing password of user %d: %v", userID, err)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE users SET password = ? WHERE id = ? AND password = ?", newHash, userID, oldHash); err != nil {
+		log.Printf("rehashing password of user %d: %v", userID, err)
 	}
-	return string(hashedPassword), nil
 }
 
 // jwt features
-func CreateJWT(email string) (string, error) {
-	expiration := time.Now().Add(24 * time.Hour)
+func CreateJWT(email, sessionID string) (string, error) {
+	expiration := time.Now().Add(AccessTokenTTL)
 
 	claims := jwt.MapClaims{}
 	claims["email"] = email
+	claims["sid"] = sessionID
 	claims["exp"] = expiration.Unix()
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte("natter-secret-key"))
+	return keyRing.Sign(claims)
+}
+
+// ParseJWT verifies a token issued by CreateJWT and returns its claims
+func ParseJWT(tokenString string) (jwt.MapClaims, error) {
+	return keyRing.Parse(tokenString)
 }
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"database/sql"
+	"natter-chat-go/models"
+	"time"
+)
+
+// BlockUser hides the two users from each other and ends any follow between
+// them, in both directions
+func BlockUser(db *sql.DB, blockerID int, username string) error {
+	blockedID, err := getUserIDByUsername(db, username)
+	if err != nil {
+		return err
+	}
+
+	if blockedID == blockerID {
+		return &PolicyError{Action: "block", Reason: "can't block yourself"}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT IGNORE INTO blocks (blocker_id, blocked_id, created_at) VALUES (?, ?, ?)"
+	if _, err := tx.Exec(query, blockerID, blockedID, time.Now()); err != nil {
+		return err
+	}
+
+	query = "DELETE FROM follows WHERE (follower_id = ? AND followee_id = ?) OR (follower_id = ? AND followee_id = ?)"
+	if _, err := tx.Exec(query, blockerID, blockedID, blockedID, blockerID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	pruneTimeline(db, blockerID, blockedID)
+	pruneTimeline(db, blockedID, blockerID)
+	return nil
+}
+
+func UnblockUser(db *sql.DB, blockerID int, username string) error {
+	blockedID, err := getUserIDByUsername(db, username)
+	if err != nil {
+		return err
+	}
+
+	return execExpectingRow(db, "DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ?", blockerID, blockedID)
+}
+
+// MuteUser keeps the user's posts out of the muter's feeds, the muted user
+// doesn't notice anything
+func MuteUser(db *sql.DB, muterID int, username string) error {
+	mutedID, err := getUserIDByUsername(db, username)
+	if err != nil {
+		return err
+	}
+
+	if mutedID == muterID {
+		return &PolicyError{Action: "mute", Reason: "can't mute yourself"}
+	}
+
+	_, err = db.Exec("INSERT IGNORE INTO mutes (muter_id, muted_id, created_at) VALUES (?, ?, ?)", muterID, mutedID, time.Now())
+	return err
+}
+
+func UnmuteUser(db *sql.DB, muterID int, username string) error {
+	mutedID, err := getUserIDByUsername(db, username)
+	if err != nil {
+		return err
+	}
+
+	return execExpectingRow(db, "DELETE FROM mutes WHERE muter_id = ? AND muted_id = ?", muterID, mutedID)
+}
+
+// ListBlockedUsers pages through the users someone blocked, latest first
+func ListBlockedUsers(db *sql.DB, userID int, page PageRequest) ([]models.RestrictedUser, models.PageInfo, error) {
+	return listRestrictedUsers(db, "blocks", "blocker_id", "blocked_id", userID, page)
+}
+
+// ListMutedUsers pages through the users someone muted, latest first
+func ListMutedUsers(db *sql.DB, userID int, page PageRequest) ([]models.RestrictedUser, models.PageInfo, error) {
+	return listRestrictedUsers(db, "mutes", "muter_id", "muted_id", userID, page)
+}
+
+func listRestrictedUsers(db *sql.DB, table, ownerColumn, targetColumn string, userID int, page PageRequest) ([]models.RestrictedUser, models.PageInfo, error) {
+	condition, order, pageArgs := page.keyset("r.created_at", "r."+targetColumn)
+
+	query := `
+		SELECT u.id, u.username, u.display_name, COALESCE(u.photo_url, ''), r.created_at
+		FROM ` + table + ` r
+		JOIN users u ON u.id = r.` + targetColumn + `
+		WHERE r.` + ownerColumn + ` = ? AND ` + condition + `
+		ORDER BY ` + order + `
+		LIMIT ?
+	`
+
+	rows, err := db.Query(query, append([]interface{}{userID}, pageArgs...)...)
+	if err != nil {
+		return nil, models.PageInfo{}, err
+	}
+	defer rows.Close()
+
+	users := []models.RestrictedUser{}
+	for rows.Next() {
+		var user models.RestrictedUser
+		var since time.Time
+		if err := rows.Scan(&user.ID, &user.Username, &user.DisplayName, &user.Photo, &since); err != nil {
+			return nil, models.PageInfo{}, err
+		}
+		user.Since = since.Format(time.RFC3339)
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	users, info := paginate(users, page, func(user models.RestrictedUser) (time.Time, int) {
+		return parseTimestamp(user.Since), user.ID
+	})
+	return users, info, nil
+}
+
+// isBlockedEitherWay reports whether one of the two users blocked the other
+func isBlockedEitherWay(db *sql.DB, userA, userB int) (bool, error) {
+	if userA == 0 || userB == 0 || userA == userB {
+		return false, nil
+	}
+
+	var count int
+	query := "SELECT COUNT(*) FROM blocks WHERE (blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)"
+	err := db.QueryRow(query, userA, userB, userB, userA).Scan(&count)
+	return count > 0, err
+}
+
+// hiddenUserIDs returns everyone blocked either way with the viewer
+func hiddenUserIDs(db *sql.DB, viewerID int) (map[int]bool, error) {
+	hidden := map[int]bool{}
+	if viewerID == 0 {
+		return hidden, nil
+	}
+
+	query := `
+		SELECT blocked_id FROM blocks WHERE blocker_id = ?
+		UNION
+		SELECT blocker_id FROM blocks WHERE blocked_id = ?
+	`
+	ids, err := queryInts(db, query, viewerID, viewerID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		hidden[id] = true
+	}
+	return hidden, nil
+}
+
+// authorFilter builds the condition that keeps content of users blocked
+// either way with the viewer out, and of muted users too when withMuted is
+// set. Anonymous viewers see everything. Content without an author, like the
+// placeholders of deleted accounts, always passes, which NOT IN wouldn't let
+// it do.
+func authorFilter(column string, viewerID int, withMuted bool) (string, []interface{}) {
+	if viewerID == 0 {
+		return "1 = 1", nil
+	}
+
+	condition := "NOT EXISTS (SELECT 1 FROM blocks b WHERE b.blocker_id = ? AND b.blocked_id = " + column + ") AND " +
+		"NOT EXISTS (SELECT 1 FROM blocks b WHERE b.blocked_id = ? AND b.blocker_id = " + column + ")"
+	args := []interface{}{viewerID, viewerID}
+
+	if withMuted {
+		condition += " AND NOT EXISTS (SELECT 1 FROM mutes m WHERE m.muter_id = ? AND m.muted_id = " + column + ")"
+		args = append(args, viewerID)
+	}
+
+	return condition, args
+}
+
+// filterUserIDs drops the hidden users from a list of user ids
+func filterUserIDs(ids []int, hidden map[int]bool) []int {
+	if len(hidden) == 0 {
+		return ids
+	}
+
+	visible := []int{}
+	for _, id := range ids {
+		if !hidden[id] {
+			visible = append(visible, id)
+		}
+	}
+	return visible
+}
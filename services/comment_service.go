@@ -3,18 +3,64 @@ package services
 import (
 	"database/sql"
 	"natter-chat-go/models"
+	"strings"
 	"time"
 )
 
+const (
+	// MaxCommentDepth is how deep replies may nest, comments on the post
+	// itself being at depth 0
+	MaxCommentDepth = 5
+	// DefaultReplyDepth is how many levels of replies are loaded below the
+	// listed comments when the client doesn't ask for a depth, MaxReplyDepth
+	// how many it may ask for
+	DefaultReplyDepth = 2
+	MaxReplyDepth     = 3
+	// RepliesPerComment is the size of the first page of replies loaded
+	// under each comment
+	RepliesPerComment = 3
+	// maxLoadedReplies caps the replies loaded for one listing, deeper ones
+	// are left to the replies endpoint
+	maxLoadedReplies = 100
+
+	deletedCommentContent = "[deleted]"
+)
+
 func CreateComment(db *sql.DB, comment *models.CreateCommentRequest) (*models.Comment, error) {
+	authorID, err := getPostAuthorID(db, comment.PostID)
+	if err != nil {
+		return nil, err
+	}
+
+	blocked, err := isBlockedEitherWay(db, comment.UserID, authorID)
+	if err != nil {
+		return nil, err
+	}
+	if blocked {
+		return nil, &PolicyError{Action: "comment", Reason: "one of you blocked the other"}
+	}
+
+	if err := authorizePostView(db, comment.UserID, comment.PostID); err != nil {
+		return nil, err
+	}
+
+	depth := 0
+	if comment.ParentID != nil {
+		parentDepth, err := checkCommentParent(db, comment)
+		if err != nil {
+			return nil, err
+		}
+		depth = parentDepth + 1
+	}
+
 	comment.CreatedAt = time.Now().Format("2006-01-02 15:04:05")
 
 	query := `
-		INSERT INTO comments (content, created_at, user_id, post_id)
-		VALUES (?, ?, ?, ?)
+		INSERT INTO comments (content, created_at, user_id, post_id, parent_id, depth)
+		VALUES (?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := db.Exec(query, comment.Content, comment.CreatedAt, comment.UserID, comment.PostID)
+	result, err := db.Exec(query, comment.Content, comment.CreatedAt, comment.UserID, comment.PostID, comment.ParentID, depth)
 	if err != nil {
 		return nil, err
 	}
@@ -30,65 +76,438 @@ func CreateComment(db *sql.DB, comment *models.CreateCommentRequest) (*models.Co
 		CreatedAt: comment.CreatedAt,
 		UserID:    comment.UserID,
 		PostID:    comment.PostID,
+		ParentID:  comment.ParentID,
 	}, nil
 }
 
-func DeleteComment(db *sql.DB, commentID int) error {
+// checkCommentParent makes sure a reply goes to a live comment on the same
+// post that isn't nested too deep already, and returns that comment's depth
+func checkCommentParent(db *sql.DB, comment *models.CreateCommentRequest) (int, error) {
+	var postID, parentAuthorID, depth int
+	var deleted bool
+	query := "SELECT post_id, COALESCE(user_id, 0), depth, deleted_at IS NOT NULL FROM comments WHERE id = ?"
+	err := db.QueryRow(query, *comment.ParentID).Scan(&postID, &parentAuthorID, &depth, &deleted)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if err == sql.ErrNoRows || postID != comment.PostID || deleted {
+		return 0, &ValidationError{Fields: map[string]string{"parentId": "must be a comment on the same post"}}
+	}
+
+	if depth+1 > MaxCommentDepth {
+		return 0, &ValidationError{Fields: map[string]string{"parentId": "the thread is too deep to reply to"}}
+	}
+
+	blocked, err := isBlockedEitherWay(db, comment.UserID, parentAuthorID)
+	if err != nil {
+		return 0, err
+	}
+	if blocked {
+		return 0, &PolicyError{Action: "reply", Reason: "one of you blocked the other"}
+	}
+
+	return depth, nil
+}
+
+// DeleteComment removes a comment. One that still has replies is blanked
+// into a placeholder instead so the thread holds together, and placeholders
+// left without replies are cleaned up on the way up.
+func DeleteComment(db *sql.DB, actor models.Actor, commentID int) error {
+	if err := authorizeCommentDelete(db, actor, commentID); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var parentID sql.NullInt64
+	var replies int
+	query := "SELECT parent_id, (SELECT COUNT(*) FROM comments r WHERE r.parent_id = c.id) FROM comments c WHERE c.id = ? FOR UPDATE"
+	if err := tx.QueryRow(query, commentID).Scan(&parentID, &replies); err != nil {
+		return err
+	}
+
+	if replies > 0 {
+		if _, err := tx.Exec("UPDATE comments SET content = '', deleted_at = ? WHERE id = ?", time.Now(), commentID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if _, err := tx.Exec("DELETE FROM comments WHERE id = ?", commentID); err != nil {
+		return err
+	}
+
+	if err := prunePlaceholders(tx, parentID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// prunePlaceholders walks up from the parent of a removed comment: a
+// placeholder parent may have lost its last reply, and its own parent with it
+func prunePlaceholders(tx *sql.Tx, parentID sql.NullInt64) error {
+	for parentID.Valid {
+		var grandparentID sql.NullInt64
+		var deleted bool
+		var replies int
+		query := "SELECT parent_id, deleted_at IS NOT NULL, (SELECT COUNT(*) FROM comments r WHERE r.parent_id = c.id) FROM comments c WHERE c.id = ? FOR UPDATE"
+		err := tx.QueryRow(query, parentID.Int64).Scan(&grandparentID, &deleted, &replies)
+		if err == sql.ErrNoRows {
+			// already pruned on the way up from a sibling
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !deleted || replies > 0 {
+			return nil
+		}
+
+		if _, err := tx.Exec("DELETE FROM comments WHERE id = ?", parentID.Int64); err != nil {
+			return err
+		}
+		parentID = grandparentID
+	}
+
+	return nil
+}
+
+// detachUserComments runs when an account goes away: comments others
+// replied to become authorless placeholders, the rest are removed and the
+// placeholders above them pruned like in DeleteComment
+func detachUserComments(tx *sql.Tx, userID int) error {
+	// the derived table keeps MySQL from refusing to read the table it changes
 	query := `
-		DELETE FROM comments
-		WHERE id = ?
+		UPDATE comments SET content = '', user_id = NULL, deleted_at = ?
+		WHERE user_id = ? AND id IN (
+			SELECT parent_id FROM (
+				SELECT r.parent_id FROM comments r JOIN comments c ON c.id = r.parent_id WHERE c.user_id = ?
+			) replied
+		)
 	`
+	if _, err := tx.Exec(query, time.Now(), userID, userID); err != nil {
+		return err
+	}
+
+	// what is left of the user's comments has no replies, only their parents
+	// can end up as empty placeholders
+	rows, err := tx.Query("SELECT DISTINCT parent_id FROM comments WHERE user_id = ? AND parent_id IS NOT NULL FOR UPDATE", userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	parentIDs := []sql.NullInt64{}
+	for rows.Next() {
+		var parentID sql.NullInt64
+		if err := rows.Scan(&parentID); err != nil {
+			return err
+		}
+		parentIDs = append(parentIDs, parentID)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM comments WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+
+	for _, parentID := range parentIDs {
+		if err := prunePlaceholders(tx, parentID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetPostComments pages through the top level comments of a post the viewer
+// can see, newest first, without those of users blocked either way. Replies
+// are loaded depth levels down.
+func GetPostComments(db *sql.DB, viewerID, postID, depth int, page PageRequest) ([]*models.CommentWithUserResponse, models.PageInfo, error) {
+	if _, err := GetVisiblePost(db, viewerID, postID); err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	filter, filterArgs := authorFilter("c.user_id", viewerID, false)
+	where := "c.post_id = ? AND c.parent_id IS NULL AND " + filter
+	comments, info, err := getComments(db, viewerID, where, append([]interface{}{postID}, filterArgs...), page)
+	if err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	if err := loadReplies(db, viewerID, comments, depth); err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	return comments, info, nil
+}
+
+// GetCommentReplies pages through the direct replies to a comment, newest
+// first, with their own replies loaded depth levels down
+func GetCommentReplies(db *sql.DB, viewerID, commentID, depth int, page PageRequest) ([]*models.CommentWithUserResponse, models.PageInfo, error) {
+	var postID, authorID int
+	var deleted bool
+	query := "SELECT post_id, COALESCE(user_id, 0), deleted_at IS NOT NULL FROM comments WHERE id = ?"
+	if err := db.QueryRow(query, commentID).Scan(&postID, &authorID, &deleted); err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	if _, err := GetVisiblePost(db, viewerID, postID); err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	if !deleted {
+		blocked, err := isBlockedEitherWay(db, viewerID, authorID)
+		if err != nil {
+			return nil, models.PageInfo{}, err
+		}
+		if blocked {
+			return nil, models.PageInfo{}, sql.ErrNoRows
+		}
+	}
+
+	replies, info, err := getReplies(db, viewerID, commentID, page)
+	if err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	if err := loadReplies(db, viewerID, replies, depth); err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	return replies, info, nil
+}
+
+// GetUserComments pages through the comments of a user on posts the viewer
+// may see, newest first
+func GetUserComments(db *sql.DB, viewerID, userID int, page PageRequest) ([]*models.CommentWithUserResponse, models.PageInfo, error) {
+	visible, visibleArgs := visibilityFilter("p", viewerID, true)
+	where := "c.user_id = ? AND c.deleted_at IS NULL AND c.post_id IN (SELECT p.id FROM posts p WHERE " + visible + ")"
+	return getComments(db, viewerID, where, append([]interface{}{userID}, visibleArgs...), page)
+}
+
+func getReplies(db *sql.DB, viewerID, parentID int, page PageRequest) ([]*models.CommentWithUserResponse, models.PageInfo, error) {
+	filter, filterArgs := authorFilter("c.user_id", viewerID, false)
+	return getComments(db, viewerID, "c.parent_id = ? AND "+filter, append([]interface{}{parentID}, filterArgs...), page)
+}
+
+// loadReplies fills in the first page of replies of every comment that has
+// any, depth levels down. Each level takes one query, and expansion stops
+// once maxLoadedReplies replies are in so a single request stays cheap.
+func loadReplies(db *sql.DB, viewerID int, comments []*models.CommentWithUserResponse, depth int) error {
+	loaded := 0
+	level := comments
+	for ; depth > 0 && len(level) > 0; depth-- {
+		parents := replyParents(level, loaded)
+		if len(parents) == 0 {
+			return nil
+		}
+
+		byParent, err := getFirstReplies(db, viewerID, parents)
+		if err != nil {
+			return err
+		}
+
+		level = attachReplies(parents, byParent)
+		loaded += len(level)
+
+		if err := fillCommentAuthors(db, level); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replyParents picks the comments of a level whose replies get loaded, in
+// order, as long as a full page under each stays within maxLoadedReplies
+func replyParents(level []*models.CommentWithUserResponse, loaded int) []*models.CommentWithUserResponse {
+	parents := []*models.CommentWithUserResponse{}
+	for _, comment := range level {
+		if comment.ReplyCount > 0 && loaded+(len(parents)+1)*RepliesPerComment <= maxLoadedReplies {
+			parents = append(parents, comment)
+		}
+	}
+	return parents
+}
+
+// attachReplies hands each parent its first page of replies and returns all
+// of them as the next level down
+func attachReplies(parents []*models.CommentWithUserResponse, byParent map[int][]*models.CommentWithUserResponse) []*models.CommentWithUserResponse {
+	level := []*models.CommentWithUserResponse{}
+	for _, parent := range parents {
+		replies, info := paginate(byParent[parent.ID], PageRequest{Limit: RepliesPerComment}, commentKey)
+		parent.Replies = replies
+		parent.RepliesNextCursor = info.NextCursor
+		level = append(level, replies...)
+	}
+	return level
+}
+
+// getFirstReplies loads the newest replies of each parent, one more than a
+// page so paginate can tell whether there are others
+func getFirstReplies(db *sql.DB, viewerID int, parents []*models.CommentWithUserResponse) (map[int][]*models.CommentWithUserResponse, error) {
+	query, args := firstRepliesQuery(viewerID, parents)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	_, err := db.Exec(query, commentID)
-	return err
+	replies, err := scanComments(rows)
+	if err != nil {
+		return nil, err
+	}
 
+	byParent := map[int][]*models.CommentWithUserResponse{}
+	for _, reply := range replies {
+		byParent[*reply.ParentID] = append(byParent[*reply.ParentID], reply)
+	}
+	return byParent, nil
 }
 
-func GetPostComments(db *sql.DB, postID int) ([]*models.CommentWithUserResponse, error) {
+func firstRepliesQuery(viewerID int, parents []*models.CommentWithUserResponse) (string, []interface{}) {
+	columns, columnArgs := commentColumns(viewerID)
+	filter, filterArgs := authorFilter("c.user_id", viewerID, false)
+
+	placeholders := make([]string, len(parents))
+	parentArgs := make([]interface{}, len(parents))
+	for i, parent := range parents {
+		placeholders[i] = "?"
+		parentArgs[i] = parent.ID
+	}
+
 	query := `
-		SELECT id, content, created_at, user_id, post_id
-		FROM comments
-		WHERE post_id = ?
-		ORDER BY created_at DESC
+		SELECT id, content, created_at, user_id, post_id, parent_id, deleted, reply_count
+		FROM (
+			SELECT ` + columns + `,
+			       ROW_NUMBER() OVER (PARTITION BY c.parent_id ORDER BY c.created_at DESC, c.id DESC) AS position
+			FROM comments c
+			WHERE c.parent_id IN (` + strings.Join(placeholders, ", ") + `) AND ` + filter + `
+		) ranked
+		WHERE position <= ?
+		ORDER BY parent_id, created_at DESC, id DESC
 	`
 
-	return getComments(db, query, postID)
+	args := append(append(append(columnArgs, parentArgs...), filterArgs...), RepliesPerComment+1)
+	return query, args
 }
 
-func GetUserComments(db *sql.DB, userID int) ([]*models.CommentWithUserResponse, error) {
+// generic function to get comments, where filters the comments table
+// aliased as c
+func getComments(db *sql.DB, viewerID int, where string, args []interface{}, page PageRequest) ([]*models.CommentWithUserResponse, models.PageInfo, error) {
+	condition, order, pageArgs := page.keyset("c.created_at", "c.id")
+	columns, columnArgs := commentColumns(viewerID)
+
 	query := `
-		SELECT id, content, created_at, user_id, post_id
-		FROM comments
-		WHERE user_id = ?
+		SELECT ` + columns + `
+		FROM comments c
+		WHERE ` + where + ` AND ` + condition + `
+		ORDER BY ` + order + `
+		LIMIT ?
 	`
-	return getComments(db, query, userID)
-}
 
-// generic function to get comments
-func getComments(db *sql.DB, query string, args ...interface{}) ([]*models.CommentWithUserResponse, error) {
+	args = append(append(columnArgs, args...), pageArgs...)
 	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, models.PageInfo{}, err
 	}
 	defer rows.Close()
 
+	comments, err := scanComments(rows)
+	if err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	comments, info := paginate(comments, page, commentKey)
+	if err := fillCommentAuthors(db, comments); err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	return comments, info, nil
+}
+
+// commentColumns selects what scanComments reads from the comments table
+// aliased as c, counting only the replies the viewer gets to see
+func commentColumns(viewerID int) (string, []interface{}) {
+	replyFilter, replyArgs := authorFilter("r.user_id", viewerID, false)
+	columns := `c.id, c.content, c.created_at, COALESCE(c.user_id, 0) AS user_id, c.post_id, c.parent_id, c.deleted_at IS NOT NULL AS deleted,
+		       (SELECT COUNT(*) FROM comments r WHERE r.parent_id = c.id AND ` + replyFilter + `) AS reply_count`
+	return columns, replyArgs
+}
+
+func scanComments(rows *sql.Rows) ([]*models.CommentWithUserResponse, error) {
 	comments := []*models.CommentWithUserResponse{}
 	for rows.Next() {
 		var comment models.CommentWithUserResponse
-		if err := rows.Scan(&comment.ID, &comment.Content, &comment.CreatedAt, &comment.UserID, &comment.PostID); err != nil {
+		var parentID sql.NullInt64
+		if err := rows.Scan(&comment.ID, &comment.Content, &comment.CreatedAt, &comment.UserID, &comment.PostID, &parentID, &comment.Deleted, &comment.ReplyCount); err != nil {
 			return nil, err
 		}
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			comment.ParentID = &id
+		}
+		comments = append(comments, &comment)
+	}
 
-		user, err := GetUserByID(db, comment.UserID)
-		if err != nil {
-			return nil, err
+	return comments, rows.Err()
+}
+
+// fillCommentAuthors looks up the authors of all the comments at once and
+// blanks out the deleted ones
+func fillCommentAuthors(db *sql.DB, comments []*models.CommentWithUserResponse) error {
+	placeholders := []string{}
+	args := []interface{}{}
+	for _, comment := range comments {
+		if comment.Deleted {
+			comment.Content = deletedCommentContent
+			comment.UserID = 0
+			continue
 		}
+		placeholders = append(placeholders, "?")
+		args = append(args, comment.UserID)
+	}
+	if len(args) == 0 {
+		return nil
+	}
 
-		comment.Username = user.Username
-		comment.UserPhoto = user.Photo
+	query := "SELECT id, username, COALESCE(photo_url, '') FROM users WHERE id IN (" + strings.Join(placeholders, ", ") + ")"
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-		comments = append(comments, &comment)
+	authors := map[int]models.CommentWithUserResponse{}
+	for rows.Next() {
+		var author models.CommentWithUserResponse
+		if err := rows.Scan(&author.UserID, &author.Username, &author.UserPhoto); err != nil {
+			return err
+		}
+		authors[author.UserID] = author
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	return comments, nil
+	for _, comment := range comments {
+		if author, ok := authors[comment.UserID]; ok {
+			comment.Username = author.Username
+			comment.UserPhoto = author.UserPhoto
+		}
+	}
+
+	return nil
+}
+
+func commentKey(comment *models.CommentWithUserResponse) (time.Time, int) {
+	return parseTimestamp(comment.CreatedAt), comment.ID
 }
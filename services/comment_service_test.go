@@ -0,0 +1,178 @@
+package services
+
+import (
+	"fmt"
+	"natter-chat-go/models"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func commentsWithReplies(counts ...int) []*models.CommentWithUserResponse {
+	comments := make([]*models.CommentWithUserResponse, len(counts))
+	for i, count := range counts {
+		comments[i] = &models.CommentWithUserResponse{ID: i + 1, ReplyCount: count}
+	}
+	return comments
+}
+
+func commentIDs(comments []*models.CommentWithUserResponse) []int {
+	result := make([]int, len(comments))
+	for i, comment := range comments {
+		result[i] = comment.ID
+	}
+	return result
+}
+
+func TestReplyParents(t *testing.T) {
+	many := make([]int, 40)
+	for i := range many {
+		many[i] = 1
+	}
+	full := maxLoadedReplies / RepliesPerComment
+
+	tests := []struct {
+		name   string
+		level  []*models.CommentWithUserResponse
+		loaded int
+		want   int
+	}{
+		{"empty level", nil, 0, 0},
+		{"no replies anywhere", commentsWithReplies(0, 0, 0), 0, 0},
+		{"skips comments without replies", commentsWithReplies(2, 0, 5, 0), 0, 2},
+		{"stops at the cap", commentsWithReplies(many...), 0, full},
+		{"counts what earlier levels loaded", commentsWithReplies(many...), maxLoadedReplies - 2*RepliesPerComment, 2},
+		{"room for exactly one more page", commentsWithReplies(1, 1), maxLoadedReplies - RepliesPerComment, 1},
+		{"no room for a full page", commentsWithReplies(1, 1), maxLoadedReplies - RepliesPerComment + 1, 0},
+		{"cap already reached", commentsWithReplies(1, 1), maxLoadedReplies, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parents := replyParents(tt.level, tt.loaded)
+			if len(parents) != tt.want {
+				t.Fatalf("got %d parents %v, want %d", len(parents), commentIDs(parents), tt.want)
+			}
+			if tt.loaded+len(parents)*RepliesPerComment > maxLoadedReplies {
+				t.Errorf("%d parents after %d loaded can go past %d replies", len(parents), tt.loaded, maxLoadedReplies)
+			}
+			for _, parent := range parents {
+				if parent.ReplyCount == 0 {
+					t.Errorf("comment %d has no replies to load", parent.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestAttachReplies(t *testing.T) {
+	base := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	reply := func(id, parentID int) *models.CommentWithUserResponse {
+		return &models.CommentWithUserResponse{
+			ID:        id,
+			ParentID:  &parentID,
+			CreatedAt: base.Add(time.Duration(id) * time.Minute).Format("2006-01-02 15:04:05"),
+		}
+	}
+
+	parents := commentsWithReplies(4, 2, 1)
+	byParent := map[int][]*models.CommentWithUserResponse{
+		// one more than a page, newest first, as getFirstReplies returns them
+		1: {reply(14, 1), reply(13, 1), reply(12, 1), reply(11, 1)},
+		2: {reply(22, 2), reply(21, 2)},
+		// parent 3 only has replies the viewer can't see
+	}
+
+	level := attachReplies(parents, byParent)
+
+	if got, want := commentIDs(level), []int{14, 13, 12, 22, 21}; !slices.Equal(got, want) {
+		t.Errorf("next level = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		parent   *models.CommentWithUserResponse
+		want     []int
+		wantMore bool
+	}{
+		{parents[0], []int{14, 13, 12}, true},
+		{parents[1], []int{22, 21}, false},
+		{parents[2], []int{}, false},
+	}
+	for _, tt := range tests {
+		if got := commentIDs(tt.parent.Replies); !slices.Equal(got, tt.want) {
+			t.Errorf("comment %d replies = %v, want %v", tt.parent.ID, got, tt.want)
+		}
+		if (tt.parent.RepliesNextCursor != "") != tt.wantMore {
+			t.Errorf("comment %d next cursor = %q, want one: %v", tt.parent.ID, tt.parent.RepliesNextCursor, tt.wantMore)
+		}
+	}
+
+	// the cursor picks up right after the last reply handed out
+	cursor := mustDecode(t, parents[0].RepliesNextCursor)
+	if cursor.ID != 12 || cursor.Backward {
+		t.Errorf("next cursor = %+v, want forward from comment 12", *cursor)
+	}
+}
+
+func TestFirstRepliesQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		viewerID int
+		parents  []*models.CommentWithUserResponse
+		in       string
+		args     []interface{}
+	}{
+		{
+			name:    "anonymous",
+			parents: commentsWithReplies(1),
+			in:      "c.parent_id IN (?) AND 1 = 1",
+			args:    []interface{}{1, RepliesPerComment + 1},
+		},
+		{
+			name:     "viewer",
+			viewerID: 7,
+			parents:  commentsWithReplies(1, 1, 1),
+			in:       "c.parent_id IN (?, ?, ?) AND NOT EXISTS",
+			// reply counts, parents, author filter, rows per parent
+			args: []interface{}{7, 7, 1, 2, 3, 7, 7, RepliesPerComment + 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := firstRepliesQuery(tt.viewerID, tt.parents)
+			if !strings.Contains(query, tt.in) {
+				t.Errorf("query doesn't select the replies of the parents with %q:\n%s", tt.in, query)
+			}
+			if !strings.Contains(query, "PARTITION BY c.parent_id ORDER BY c.created_at DESC, c.id DESC") ||
+				!strings.Contains(query, "WHERE position <= ?") {
+				t.Errorf("query doesn't take the newest replies per parent:\n%s", query)
+			}
+			if placeholders := strings.Count(query, "?"); placeholders != len(args) {
+				t.Errorf("query has %d placeholders for %d args", placeholders, len(args))
+			}
+			if fmt.Sprint(args) != fmt.Sprint(tt.args) {
+				t.Errorf("args = %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestFillCommentAuthorsBlanksPlaceholders(t *testing.T) {
+	comments := []*models.CommentWithUserResponse{
+		{ID: 1, Content: "", UserID: 3, Deleted: true},
+		{ID: 2, Content: "", UserID: 0, Deleted: true},
+	}
+
+	// nothing but placeholders, so no authors to look up
+	if err := fillCommentAuthors(nil, comments); err != nil {
+		t.Fatalf("fillCommentAuthors: %v", err)
+	}
+
+	for _, comment := range comments {
+		if comment.Content != deletedCommentContent || comment.UserID != 0 || comment.Username != "" {
+			t.Errorf("comment %d = %+v, want an authorless %q placeholder", comment.ID, *comment, deletedCommentContent)
+		}
+	}
+}
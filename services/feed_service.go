@@ -0,0 +1,76 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"natter-chat-go/models"
+)
+
+const (
+	// FeedFanOutOnRead merges the followed accounts every time the feed is read
+	FeedFanOutOnRead = "read"
+	// FeedFanOutOnWrite copies each post into the timeline of every follower
+	FeedFanOutOnWrite = "write"
+
+	// how many recent posts a new follow copies into the timeline
+	timelineBackfillLimit = 200
+)
+
+func fanOutOnWrite() bool {
+	return appConfig.Feed.Strategy == FeedFanOutOnWrite
+}
+
+// GetHomeTimeline pages through the posts of the user and everyone they
+// follow, newest first
+func GetHomeTimeline(db *sql.DB, userID int, page PageRequest) ([]models.Post, models.PageInfo, error) {
+	filter, filterArgs := authorFilter("p.user_id", userID, true)
+
+	if fanOutOnWrite() {
+		args := append([]interface{}{userID}, filterArgs...)
+		return listPosts(db, userID, "JOIN home_timeline t ON t.post_id = p.id AND t.user_id = ?", filter, args, page)
+	}
+
+	where := "(p.user_id = ? OR p.user_id IN (SELECT followee_id FROM follows WHERE follower_id = ? AND status = 'accepted')) AND " + filter
+	return listPosts(db, userID, "", where, append([]interface{}{userID, userID}, filterArgs...), page)
+}
+
+// fanOutPost copies a new post into the timelines of its author and their
+// followers. A failure only leaves timelines incomplete, so it is logged.
+func fanOutPost(db *sql.DB, postID, authorID int) {
+	if !fanOutOnWrite() {
+		return
+	}
+
+	query := `
+		INSERT IGNORE INTO home_timeline (user_id, post_id, author_id)
+		SELECT ?, ?, ?
+		UNION ALL
+		SELECT follower_id, ?, ? FROM follows WHERE followee_id = ? AND status = 'accepted'
+	`
+	if _, err := db.Exec(query, authorID, postID, authorID, postID, authorID, authorID); err != nil {
+		log.Printf("fanning out post %d: %v", postID, err)
+	}
+}
+
+// backfillTimeline runs when a follow is accepted
+func backfillTimeline(db *sql.DB, followerID, followeeID int) {
+	if !fanOutOnWrite() {
+		return
+	}
+
+	query := `
+		INSERT IGNORE INTO home_timeline (user_id, post_id, author_id)
+		SELECT ?, id, user_id FROM posts WHERE user_id = ? ORDER BY id DESC LIMIT ?
+	`
+	if _, err := db.Exec(query, followerID, followeeID, timelineBackfillLimit); err != nil {
+		log.Printf("backfilling timeline of user %d: %v", followerID, err)
+	}
+}
+
+// pruneTimeline runs when a follow ends. It runs in both strategies so a
+// switch back to write doesn't show posts of accounts no longer followed.
+func pruneTimeline(db *sql.DB, followerID, followeeID int) {
+	if _, err := db.Exec("DELETE FROM home_timeline WHERE user_id = ? AND author_id = ?", followerID, followeeID); err != nil {
+		log.Printf("pruning timeline of user %d: %v", followerID, err)
+	}
+}
@@ -0,0 +1,296 @@
+package services
+
+import (
+	"database/sql"
+	"natter-chat-go/models"
+	"time"
+)
+
+const (
+	FollowPending  = "pending"
+	FollowAccepted = "accepted"
+	// FollowNone is reported when there is no relationship at all
+	FollowNone = "none"
+)
+
+// Follow follows the account, or asks to when it is private. Following again
+// keeps the current state.
+func Follow(db *sql.DB, followerID int, username string) (string, error) {
+	var followeeID int
+	var isPrivate bool
+	err := db.QueryRow("SELECT id, is_private FROM users WHERE username = ?", username).Scan(&followeeID, &isPrivate)
+	if err != nil {
+		return "", err
+	}
+
+	if followeeID == followerID {
+		return "", &PolicyError{Action: "follow", Reason: "can't follow yourself"}
+	}
+
+	blocked, err := isBlockedEitherWay(db, followerID, followeeID)
+	if err != nil {
+		return "", err
+	}
+	if blocked {
+		return "", &PolicyError{Action: "follow", Reason: "one of you blocked the other"}
+	}
+
+	status, err := getFollowStatus(db, followerID, followeeID)
+	if err != nil || status != FollowNone {
+		return status, err
+	}
+
+	now := time.Now()
+	status = FollowAccepted
+	var acceptedAt sql.NullTime
+	if isPrivate {
+		status = FollowPending
+	} else {
+		acceptedAt = sql.NullTime{Time: now, Valid: true}
+	}
+
+	query := `
+		INSERT INTO follows (follower_id, followee_id, status, created_at, accepted_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE id = id
+	`
+	if _, err := db.Exec(query, followerID, followeeID, status, now, acceptedAt); err != nil {
+		return "", err
+	}
+
+	status, err = getFollowStatus(db, followerID, followeeID)
+	if err != nil {
+		return "", err
+	}
+
+	if status == FollowAccepted {
+		backfillTimeline(db, followerID, followeeID)
+	}
+
+	return status, nil
+}
+
+// Unfollow stops following the account, or withdraws a pending request
+func Unfollow(db *sql.DB, followerID int, username string) error {
+	followeeID, err := getUserIDByUsername(db, username)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", followerID, followeeID); err != nil {
+		return err
+	}
+
+	pruneTimeline(db, followerID, followeeID)
+	return nil
+}
+
+// GetFollowStatus reports whether the caller follows the account
+func GetFollowStatus(db *sql.DB, followerID int, username string) (string, error) {
+	followeeID, err := getUserIDByUsername(db, username)
+	if err != nil {
+		return "", err
+	}
+
+	return getFollowStatus(db, followerID, followeeID)
+}
+
+func getFollowStatus(db *sql.DB, followerID, followeeID int) (string, error) {
+	var status string
+	err := db.QueryRow("SELECT status FROM follows WHERE follower_id = ? AND followee_id = ?", followerID, followeeID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return FollowNone, nil
+	}
+	return status, err
+}
+
+// ListFollowers pages through the accepted followers of an account, newest
+// first. A private account only shows them to itself and its followers.
+func ListFollowers(db *sql.DB, viewerID int, username string, page PageRequest) ([]models.FollowUser, models.PageInfo, error) {
+	userID, err := authorizeFollowList(db, viewerID, username)
+	if err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	return listFollows(db, "f.followee_id = ? AND f.status = 'accepted'", "f.follower_id", userID, page)
+}
+
+// ListFollowing pages through the accounts someone follows, newest first
+func ListFollowing(db *sql.DB, viewerID int, username string, page PageRequest) ([]models.FollowUser, models.PageInfo, error) {
+	userID, err := authorizeFollowList(db, viewerID, username)
+	if err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	return listFollows(db, "f.follower_id = ? AND f.status = 'accepted'", "f.followee_id", userID, page)
+}
+
+// ListFollowRequests pages through the pending requests to follow the user
+func ListFollowRequests(db *sql.DB, userID int, page PageRequest) ([]models.FollowUser, models.PageInfo, error) {
+	return listFollows(db, "f.followee_id = ? AND f.status = 'pending'", "f.follower_id", userID, page)
+}
+
+// AcceptFollowRequest lets the requester follow the user
+func AcceptFollowRequest(db *sql.DB, userID int, requesterUsername string) error {
+	requesterID, err := getUserIDByUsername(db, requesterUsername)
+	if err != nil {
+		return err
+	}
+
+	query := "UPDATE follows SET status = 'accepted', accepted_at = ? WHERE follower_id = ? AND followee_id = ? AND status = 'pending'"
+	if err := execExpectingRow(db, query, time.Now(), requesterID, userID); err != nil {
+		return err
+	}
+
+	backfillTimeline(db, requesterID, userID)
+	return nil
+}
+
+// RejectFollowRequest drops a pending request
+func RejectFollowRequest(db *sql.DB, userID int, requesterUsername string) error {
+	requesterID, err := getUserIDByUsername(db, requesterUsername)
+	if err != nil {
+		return err
+	}
+
+	query := "DELETE FROM follows WHERE follower_id = ? AND followee_id = ? AND status = 'pending'"
+	return execExpectingRow(db, query, requesterID, userID)
+}
+
+// RemoveFollower makes someone stop following the user
+func RemoveFollower(db *sql.DB, userID int, followerUsername string) error {
+	followerID, err := getUserIDByUsername(db, followerUsername)
+	if err != nil {
+		return err
+	}
+
+	query := "DELETE FROM follows WHERE follower_id = ? AND followee_id = ? AND status = 'accepted'"
+	if err := execExpectingRow(db, query, followerID, userID); err != nil {
+		return err
+	}
+
+	pruneTimeline(db, followerID, userID)
+	return nil
+}
+
+// canSeePrivateContent reports whether the viewer may see what a private
+// account only shares with its followers
+func canSeePrivateContent(db *sql.DB, viewerID, ownerID int) (bool, error) {
+	if viewerID == ownerID {
+		return true, nil
+	}
+	if viewerID == 0 {
+		return false, nil
+	}
+
+	status, err := getFollowStatus(db, viewerID, ownerID)
+	return status == FollowAccepted, err
+}
+
+func authorizeFollowList(db *sql.DB, viewerID int, username string) (int, error) {
+	var userID int
+	var isPrivate bool
+	if err := db.QueryRow("SELECT id, is_private FROM users WHERE username = ?", username).Scan(&userID, &isPrivate); err != nil {
+		return 0, err
+	}
+
+	if isPrivate {
+		allowed, err := canSeePrivateContent(db, viewerID, userID)
+		if err != nil {
+			return 0, err
+		}
+		if !allowed {
+			return 0, &PolicyError{Action: "view follows", Reason: "the account is private"}
+		}
+	}
+
+	return userID, nil
+}
+
+// listFollows pages through follows, most recent first
+func listFollows(db *sql.DB, where, userColumn string, userID int, page PageRequest) ([]models.FollowUser, models.PageInfo, error) {
+	condition, order, pageArgs := page.keyset("COALESCE(f.accepted_at, f.created_at)", "f.id")
+
+	query := `
+		SELECT f.id, u.id, u.username, u.display_name, COALESCE(u.photo_url, ''), COALESCE(f.accepted_at, f.created_at)
+		FROM follows f
+		JOIN users u ON u.id = ` + userColumn + `
+		WHERE ` + where + ` AND ` + condition + `
+		ORDER BY ` + order + `
+		LIMIT ?
+	`
+
+	rows, err := db.Query(query, append([]interface{}{userID}, pageArgs...)...)
+	if err != nil {
+		return nil, models.PageInfo{}, err
+	}
+	defer rows.Close()
+
+	users := []models.FollowUser{}
+	for rows.Next() {
+		var user models.FollowUser
+		var since time.Time
+		if err := rows.Scan(&user.FollowID, &user.ID, &user.Username, &user.DisplayName, &user.Photo, &since); err != nil {
+			return nil, models.PageInfo{}, err
+		}
+		user.Since = since.Format(time.RFC3339)
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	users, info := paginate(users, page, func(user models.FollowUser) (time.Time, int) {
+		return parseTimestamp(user.Since), user.FollowID
+	})
+	return users, info, nil
+}
+
+// acceptPendingFollowRequests runs when an account goes public and returns
+// who got in
+func acceptPendingFollowRequests(tx *sql.Tx, userID int) ([]int, error) {
+	rows, err := tx.Query("SELECT follower_id FROM follows WHERE followee_id = ? AND status = 'pending' FOR UPDATE", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	followerIDs := []int{}
+	for rows.Next() {
+		var followerID int
+		if err := rows.Scan(&followerID); err != nil {
+			return nil, err
+		}
+		followerIDs = append(followerIDs, followerID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE follows SET status = 'accepted', accepted_at = ? WHERE followee_id = ? AND status = 'pending'", time.Now(), userID)
+	return followerIDs, err
+}
+
+func getUserIDByUsername(db *sql.DB, username string) (int, error) {
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	return userID, err
+}
+
+// execExpectingRow turns an update that touched nothing into sql.ErrNoRows
+func execExpectingRow(db *sql.DB, query string, args ...interface{}) error {
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
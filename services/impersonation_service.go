@@ -0,0 +1,120 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"natter-chat-go/models"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// impersonation sessions can't be refreshed past this
+const impersonationTTL = time.Hour
+
+const (
+	AuditImpersonationStarted = "impersonation.started"
+	AuditImpersonationRequest = "impersonation.request"
+	AuditImpersonationBlocked = "impersonation.blocked"
+	AuditImpersonationEnded   = "impersonation.ended"
+)
+
+// StartImpersonation opens a session as the target user on behalf of an
+// admin. The session is short lived, remembers the admin and, when readOnly
+// is set, refuses every write.
+func StartImpersonation(db *sql.DB, actor models.Actor, targetUserID int, reason string, readOnly bool, client models.ClientInfo) (*models.TokenPair, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" || len(reason) > 500 {
+		return nil, &ValidationError{Fields: map[string]string{"reason": "is required and must be at most 500 characters"}}
+	}
+
+	if targetUserID == actor.UserID {
+		return nil, &PolicyError{Action: "impersonate user", Reason: "can't impersonate yourself"}
+	}
+
+	target, err := GetUserByID(db, targetUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	// acting as another admin would be a way around the audit trail
+	permissions, err := GetUserPermissions(db, target.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, permission := range permissions {
+		if permission == PermManageUsers {
+			return nil, &PolicyError{Action: "impersonate user", Reason: "the user is an administrator"}
+		}
+	}
+
+	sessionID, err := generateToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	query := `
+		INSERT INTO sessions (id, user_id, impersonator_id, read_only, user_agent, ip, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	userAgent := client.UserAgent
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	_, err = db.Exec(query, sessionID, target.ID, actor.UserID, readOnly, userAgent, client.IP, now, now, now.Add(impersonationTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	RecordAuditEvent(db, models.AuditEvent{
+		Event:   AuditImpersonationStarted,
+		UserID:  target.ID,
+		ActorID: actor.UserID,
+		IP:      client.IP,
+		Detail:  fmt.Sprintf("session=%s read_only=%t reason=%s", sessionID, readOnly, reason),
+	})
+
+	return issueTokenPair(db, sessionID, target.Email, target.ID, actor.UserID)
+}
+
+// EndImpersonation revokes an impersonation session
+func EndImpersonation(db *sql.DB, sessionID string, ip string) error {
+	var userID, impersonatorID int
+	query := "SELECT user_id, COALESCE(impersonator_id, 0) FROM sessions WHERE id = ?"
+	if err := db.QueryRow(query, sessionID).Scan(&userID, &impersonatorID); err != nil {
+		return err
+	}
+
+	if impersonatorID == 0 {
+		return &PolicyError{Action: "end impersonation", Reason: "not an impersonation session"}
+	}
+
+	if err := RevokeSession(db, sessionID); err != nil {
+		return err
+	}
+
+	RecordAuditEvent(db, models.AuditEvent{
+		Event:   AuditImpersonationEnded,
+		UserID:  userID,
+		ActorID: impersonatorID,
+		IP:      ip,
+		Detail:  "session=" + sessionID,
+	})
+
+	return nil
+}
+
+// createImpersonationJWT adds the impersonated user as sub and the admin as
+// the acting party, following the act claim of RFC 8693
+func createImpersonationJWT(email, sessionID string, userID, impersonatorID int) (string, error) {
+	claims := jwt.MapClaims{}
+	claims["email"] = email
+	claims["sid"] = sessionID
+	claims["sub"] = userID
+	claims["act"] = map[string]interface{}{"sub": impersonatorID}
+	claims["exp"] = time.Now().Add(AccessTokenTTL).Unix()
+
+	return keyRing.Sign(claims)
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"natter-chat-go/config"
+	"natter-chat-go/models"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+var (
+	ErrNoSigningKey = errors.New("no active signing key")
+	ErrUnknownKey   = errors.New("unknown or retired signing key")
+)
+
+type signingKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+	notBefore time.Time
+	retireAt  time.Time
+}
+
+func (k *signingKey) retired(now time.Time) bool {
+	return !k.retireAt.IsZero() && !now.Before(k.retireAt)
+}
+
+// KeyRing holds every key that may sign or verify our tokens
+type KeyRing struct {
+	keys []*signingKey
+}
+
+var keyRing *KeyRing
+
+// SetKeyRing installs the key ring used by CreateJWT and ParseJWT
+func SetKeyRing(ring *KeyRing) {
+	keyRing = ring
+}
+
+func NewKeyRing(cfg config.JWTConfig) (*KeyRing, error) {
+	ring := &KeyRing{}
+	seen := map[string]bool{}
+
+	for _, keyCfg := range cfg.Keys {
+		if keyCfg.ID == "" {
+			return nil, errors.New("signing key without kid")
+		}
+		if seen[keyCfg.ID] {
+			return nil, fmt.Errorf("duplicate signing key kid: %s", keyCfg.ID)
+		}
+		seen[keyCfg.ID] = true
+
+		key, err := loadSigningKey(keyCfg)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %s: %w", keyCfg.ID, err)
+		}
+		ring.keys = append(ring.keys, key)
+	}
+
+	// newest keys first so the signing key lookup picks the latest one
+	sort.SliceStable(ring.keys, func(i, j int) bool {
+		return ring.keys[i].notBefore.After(ring.keys[j].notBefore)
+	})
+
+	return ring, nil
+}
+
+func loadSigningKey(cfg config.SigningKeyConfig) (*signingKey, error) {
+	key := &signingKey{
+		id:        cfg.ID,
+		notBefore: cfg.NotBefore,
+		retireAt:  cfg.RetireAt,
+	}
+
+	switch cfg.Algorithm {
+	case "HS256":
+		if cfg.Secret == "" {
+			return nil, errors.New("HS256 key requires a secret")
+		}
+		key.method = jwt.SigningMethodHS256
+		key.signKey = []byte(cfg.Secret)
+		key.verifyKey = []byte(cfg.Secret)
+	case "RS256":
+		pem, err := os.ReadFile(cfg.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+		if err != nil {
+			return nil, err
+		}
+		key.method = jwt.SigningMethodRS256
+		key.signKey = privateKey
+		key.verifyKey = &privateKey.PublicKey
+	case "EdDSA":
+		pem, err := os.ReadFile(cfg.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+		if err != nil {
+			return nil, err
+		}
+		edKey, ok := privateKey.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an ed25519 private key")
+		}
+		key.method = jwt.SigningMethodEdDSA
+		key.signKey = edKey
+		key.verifyKey = edKey.Public()
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", cfg.Algorithm)
+	}
+
+	return key, nil
+}
+
+func (k *KeyRing) signingKey(now time.Time) (*signingKey, error) {
+	for _, key := range k.keys {
+		if !now.Before(key.notBefore) && !key.retired(now) {
+			return key, nil
+		}
+	}
+	return nil, ErrNoSigningKey
+}
+
+func (k *KeyRing) verificationKey(kid string, now time.Time) (*signingKey, error) {
+	for _, key := range k.keys {
+		if key.id == kid && !key.retired(now) {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// Sign signs the claims with the current signing key and sets its kid header
+func (k *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	key, err := k.signingKey(time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.signKey)
+}
+
+// Parse verifies a token against the key named by its kid header
+func (k *KeyRing) Parse(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+
+		key, err := k.verificationKey(kid, time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		// the alg header must match the key, otherwise a public key could be
+		// abused as an HMAC secret
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %s", token.Method.Alg())
+		}
+
+		return key.verifyKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, jwt.ErrSignatureInvalid
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("invalid token claims")
+	}
+
+	return claims, nil
+}
+
+// JWKS publishes the public half of every asymmetric key that still verifies
+func (k *KeyRing) JWKS() models.JWKS {
+	jwks := models.JWKS{Keys: []models.JWK{}}
+	now := time.Now()
+
+	for _, key := range k.keys {
+		if key.retired(now) {
+			continue
+		}
+
+		switch publicKey := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, models.JWK{
+				KeyID:     key.id,
+				KeyType:   "RSA",
+				Algorithm: key.method.Alg(),
+				Use:       "sig",
+				N:         base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			jwks.Keys = append(jwks.Keys, models.JWK{
+				KeyID:     key.id,
+				KeyType:   "OKP",
+				Algorithm: key.method.Alg(),
+				Use:       "sig",
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(publicKey),
+			})
+		}
+	}
+
+	return jwks
+}
@@ -11,6 +11,9 @@ func ModifyPostLike(db *sql.DB, userID *int, postID *int, action string) error {
 
 	switch action {
 	case "like":
+		if err := authorizePostView(db, *userID, *postID); err != nil {
+			return err
+		}
 		query = `
 			INSERT INTO post_likes (user_id, post_id)
 			VALUES (?, ?)
@@ -80,20 +83,29 @@ func GetLikedPostsByUserID(db *sql.DB, userID int) ([]int, error) {
 	return likedPosts, nil
 }
 
-func GetLikedPostsDetailsByUserID(db *sql.DB, userID int) ([]models.Post, error) {
-	postIDs, err := GetLikedPostsByUserID(db, userID)
+// GetLikedPostsDetailsByUserID pages through the posts a user liked, newest
+// post first
+func GetLikedPostsDetailsByUserID(db *sql.DB, viewerID, userID int, page PageRequest) ([]models.Post, models.PageInfo, error) {
+	blocked, err := isBlockedEitherWay(db, viewerID, userID)
 	if err != nil {
-		return nil, err
+		return nil, models.PageInfo{}, err
+	}
+	if blocked {
+		// same as a missing account, so the block isn't revealed
+		return nil, models.PageInfo{}, sql.ErrNoRows
 	}
 
-	var posts []models.Post
-	for _, postID := range postIDs {
-		post, err := GetPostByID(db, postID)
-		if err != nil {
-			return nil, err
-		}
-		posts = append(posts, *post)
+	where, args := authorFilter("p.user_id", viewerID, false)
+	return listPosts(db, viewerID, "JOIN post_likes pl ON pl.post_id = p.id AND pl.user_id = ?", where, append([]interface{}{userID}, args...), page)
+}
+
+// GetVisiblePostLikes lists who liked a post, leaving out users blocked
+// either way with the viewer
+func GetVisiblePostLikes(db *sql.DB, viewerID, postID int) ([]int, error) {
+	post, err := GetVisiblePost(db, viewerID, postID)
+	if err != nil {
+		return nil, err
 	}
 
-	return posts, nil
+	return post.LikedBy, nil
 }
@@ -0,0 +1,217 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"natter-chat-go/mailer"
+	"natter-chat-go/models"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// failures allowed before backoff kicks in, per account and per ip
+	accountFreeAttempts = 3
+	ipFreeAttempts      = 20
+	ipAttemptWindow     = 15 * time.Minute
+	maxLoginBackoff     = 15 * time.Minute
+
+	accountLockThreshold = 10
+	accountLockDuration  = time.Hour
+	unlockTokenTTL       = 24 * time.Hour
+)
+
+var (
+	ErrAccountLocked     = errors.New("account temporarily locked, check your email to unlock it")
+	ErrInvalidUnlockLink = errors.New("invalid or expired unlock link")
+)
+
+// LoginThrottledError is returned while a login is in backoff
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, retry in %d seconds", int(e.RetryAfter.Seconds())+1)
+}
+
+// backoff doubles with every failure past the free attempts
+func backoff(failures, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+	exponent := failures - free
+	if exponent > 10 {
+		return maxLoginBackoff
+	}
+	delay := time.Duration(1<<exponent) * time.Second
+	if delay > maxLoginBackoff {
+		return maxLoginBackoff
+	}
+	return delay
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// checkLoginAllowed runs before the password is even looked at, so a
+// throttled attacker learns nothing about it
+func checkLoginAllowed(db *sql.DB, email, ip string) error {
+	now := time.Now()
+
+	var failedCount int
+	var lastFailedAt time.Time
+	var lockedUntil sql.NullTime
+	err := db.QueryRow("SELECT failed_count, last_failed_at, locked_until FROM login_throttles WHERE email = ?", email).Scan(&failedCount, &lastFailedAt, &lockedUntil)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if err == nil {
+		if lockedUntil.Valid && now.Before(lockedUntil.Time) {
+			return ErrAccountLocked
+		}
+
+		if wait := lastFailedAt.Add(backoff(failedCount, accountFreeAttempts)).Sub(now); wait > 0 {
+			RecordAuditEvent(db, models.AuditEvent{Event: AuditLoginThrottled, IP: ip, Detail: "account backoff for " + email})
+			return &LoginThrottledError{RetryAfter: wait}
+		}
+	}
+
+	var ipFailures int
+	var lastIPFailure sql.NullTime
+	query := "SELECT COUNT(*), MAX(created_at) FROM login_attempts WHERE ip = ? AND succeeded = FALSE AND created_at > ?"
+	if err := db.QueryRow(query, ip, now.Add(-ipAttemptWindow)).Scan(&ipFailures, &lastIPFailure); err != nil {
+		return err
+	}
+
+	if lastIPFailure.Valid {
+		if wait := lastIPFailure.Time.Add(backoff(ipFailures, ipFreeAttempts)).Sub(now); wait > 0 {
+			RecordAuditEvent(db, models.AuditEvent{Event: AuditLoginThrottled, IP: ip, Detail: "ip backoff"})
+			return &LoginThrottledError{RetryAfter: wait}
+		}
+	}
+
+	return nil
+}
+
+func recordLoginSuccess(db *sql.DB, email, ip string) error {
+	if _, err := db.Exec("INSERT INTO login_attempts (email, ip, succeeded, created_at) VALUES (?, ?, TRUE, ?)", email, ip, time.Now()); err != nil {
+		return err
+	}
+
+	_, err := db.Exec("DELETE FROM login_throttles WHERE email = ?", email)
+	return err
+}
+
+// recordLoginFailure counts the failure and locks the account once it
+// crosses the threshold, emailing an unlock link to the owner if there is one
+func recordLoginFailure(db *sql.DB, email, ip string) error {
+	now := time.Now()
+	if _, err := db.Exec("INSERT INTO login_attempts (email, ip, succeeded, created_at) VALUES (?, ?, FALSE, ?)", email, ip, now); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO login_throttles (email, failed_count, last_failed_at)
+		VALUES (?, 1, ?)
+		ON DUPLICATE KEY UPDATE failed_count = failed_count + 1, last_failed_at = VALUES(last_failed_at)
+	`
+	if _, err := db.Exec(query, email, now); err != nil {
+		return err
+	}
+
+	var failedCount int
+	if err := db.QueryRow("SELECT failed_count FROM login_throttles WHERE email = ?", email).Scan(&failedCount); err != nil {
+		return err
+	}
+
+	if failedCount < accountLockThreshold || failedCount%accountLockThreshold != 0 {
+		return nil
+	}
+
+	if _, err := db.Exec("UPDATE login_throttles SET locked_until = ? WHERE email = ?", now.Add(accountLockDuration), email); err != nil {
+		return err
+	}
+
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	RecordAuditEvent(db, models.AuditEvent{Event: AuditLoginLocked, UserID: userID, IP: ip, Detail: fmt.Sprintf("%d failed attempts", failedCount)})
+	return sendUnlockEmail(db, email)
+}
+
+func sendUnlockEmail(db *sql.DB, email string) error {
+	token, err := generateToken(32)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = db.Exec("INSERT INTO account_unlock_tokens (token_hash, email, created_at, expires_at) VALUES (?, ?, ?, ?)", hashToken(token), email, now, now.Add(unlockTokenTTL))
+	if err != nil {
+		return err
+	}
+
+	link := appConfig.AppBaseURL + "/unlock-account?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      email,
+		Subject: "Your Natter account was locked",
+		Body:    "We locked your Natter account after too many failed login attempts.\n\nIf it was you, unlock it here:\n\n" + link + "\n\nIf it wasn't, consider resetting your password.\n",
+	}
+
+	go func() {
+		if err := mailSender.Send(msg); err != nil {
+			log.Printf("sending unlock email: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// UnlockAccount consumes an unlock link and clears the failed attempts
+func UnlockAccount(db *sql.DB, token, ip string) error {
+	var email string
+	var expiresAt time.Time
+	err := db.QueryRow("SELECT email, expires_at FROM account_unlock_tokens WHERE token_hash = ? AND used_at IS NULL", hashToken(token)).Scan(&email, &expiresAt)
+	if err == sql.ErrNoRows {
+		return ErrInvalidUnlockLink
+	}
+	if err != nil {
+		return err
+	}
+
+	if time.Now().After(expiresAt) {
+		return ErrInvalidUnlockLink
+	}
+
+	result, err := db.Exec("UPDATE account_unlock_tokens SET used_at = ? WHERE token_hash = ? AND used_at IS NULL", time.Now(), hashToken(token))
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return ErrInvalidUnlockLink
+	}
+
+	if _, err := db.Exec("DELETE FROM login_throttles WHERE email = ?", email); err != nil {
+		return err
+	}
+
+	var userID int
+	if err := db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	RecordAuditEvent(db, models.AuditEvent{Event: AuditLoginUnlocked, UserID: userID, IP: ip})
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"natter-chat-go/mailer"
+	"natter-chat-go/models"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	magicLinkTTL         = 15 * time.Minute
+	magicLinkPurpose     = "magic_link"
+	magicLinkCooldown    = time.Minute
+	maxMagicLinksPerHour = 5
+)
+
+var ErrInvalidMagicLink = errors.New("invalid or expired login link")
+
+// RequestMagicLink emails a single-use login link when the email belongs to
+// an account. It never reports whether it does, only the rate limit shows.
+func RequestMagicLink(db *sql.DB, email string) error {
+	email = normalizeEmail(email)
+
+	var lastRequested sql.NullTime
+	var requestedLastHour int
+	query := `
+		SELECT MAX(requested_at), COUNT(CASE WHEN requested_at > ? THEN 1 END)
+		FROM magic_link_requests
+		WHERE email = ?
+	`
+	err := db.QueryRow(query, time.Now().Add(-time.Hour), email).Scan(&lastRequested, &requestedLastHour)
+	if err != nil {
+		return err
+	}
+
+	if (lastRequested.Valid && time.Since(lastRequested.Time) < magicLinkCooldown) || requestedLastHour >= maxMagicLinksPerHour {
+		return ErrTooManyRequests
+	}
+
+	now := time.Now()
+	if _, err := db.Exec("INSERT INTO magic_link_requests (email, requested_at) VALUES (?, ?)", email, now); err != nil {
+		return err
+	}
+
+	var userID int
+	err = db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	jti, err := generateToken(16)
+	if err != nil {
+		return err
+	}
+
+	expiresAt := now.Add(magicLinkTTL)
+	token, err := keyRing.Sign(jwt.MapClaims{
+		"sub":     userID,
+		"email":   email,
+		"purpose": magicLinkPurpose,
+		"jti":     jti,
+		"exp":     expiresAt.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO magic_link_tokens (jti, user_id, email, created_at, expires_at) VALUES (?, ?, ?, ?, ?)", jti, userID, email, now, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	link := appConfig.AppBaseURL + "/magic-link?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      email,
+		Subject: "Your Natter login link",
+		Body:    "Log in to Natter by opening this link:\n\n" + link + "\n\nThe link works once and expires in 15 minutes. If you didn't ask for it, ignore this email.\n",
+	}
+
+	// same reasoning as the password reset, don't let timing tell accounts apart
+	go func() {
+		if err := mailSender.Send(msg); err != nil {
+			log.Printf("sending login link to user %d: %v", userID, err)
+		}
+	}()
+
+	return nil
+}
+
+// ConsumeMagicLink burns the link and logs the user in the same way a
+// password login would, including the second factor
+func ConsumeMagicLink(db *sql.DB, token string, client models.ClientInfo) (*models.LoginResult, error) {
+	claims, err := keyRing.Parse(token)
+	if err != nil {
+		return nil, ErrInvalidMagicLink
+	}
+
+	purpose, _ := claims["purpose"].(string)
+	jti, _ := claims["jti"].(string)
+	email, _ := claims["email"].(string)
+	if purpose != magicLinkPurpose || jti == "" {
+		return nil, ErrInvalidMagicLink
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var expiresAt time.Time
+	query := "SELECT user_id, expires_at FROM magic_link_tokens WHERE jti = ? AND email = ? AND used_at IS NULL FOR UPDATE"
+	err = tx.QueryRow(query, jti, email).Scan(&userID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidMagicLink
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, ErrInvalidMagicLink
+	}
+
+	// burn this link and any other outstanding one
+	if _, err := tx.Exec("UPDATE magic_link_tokens SET used_at = ? WHERE user_id = ? AND used_at IS NULL", time.Now(), userID); err != nil {
+		return nil, err
+	}
+
+	// the link only counts for the address it was sent to
+	var currentEmail string
+	if err := tx.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&currentEmail); err != nil {
+		return nil, err
+	}
+	if normalizeEmail(currentEmail) != email {
+		return nil, ErrInvalidMagicLink
+	}
+
+	// opening the link proves the user owns the address
+	if _, err := tx.Exec("UPDATE users SET email_verified_at = ? WHERE id = ? AND email_verified_at IS NULL", time.Now(), userID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	user, err := GetUserByID(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return completeLogin(db, user, client)
+}
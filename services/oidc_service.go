@@ -0,0 +1,561 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"natter-chat-go/config"
+	"natter-chat-go/models"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	oidcStateTTL     = 10 * time.Minute
+	oidcJWKSCacheTTL = time.Hour
+	// unknown kids refetch the key set at most this often, so tokens with
+	// made up kids can't make us hammer the provider
+	oidcJWKSMinRefetch = time.Minute
+)
+
+var (
+	ErrUnknownOIDCProvider = errors.New("unknown identity provider")
+	ErrInvalidOIDCState    = errors.New("invalid or expired login state")
+	ErrInvalidIDToken      = errors.New("invalid id token")
+	ErrOIDCEmailUnverified = errors.New("the identity provider did not verify this email, log in with your password and link the account instead")
+	ErrOIDCWrongIdentity   = errors.New("this identity is not linked to your account")
+)
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider lazily fetches and caches the provider metadata and keys
+type oidcProvider struct {
+	cfg config.OIDCProviderConfig
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+	// keysCheckedAt is the last fetch attempt, failed ones included
+	keysCheckedAt time.Time
+}
+
+var oidcProviders = map[string]*oidcProvider{}
+
+func configureOIDCProviders(cfgs []config.OIDCProviderConfig) {
+	providers := map[string]*oidcProvider{}
+	for _, cfg := range cfgs {
+		providers[cfg.Name] = &oidcProvider{cfg: cfg}
+	}
+	oidcProviders = providers
+}
+
+func getOIDCProvider(name string) (*oidcProvider, error) {
+	provider, ok := oidcProviders[name]
+	if !ok {
+		return nil, ErrUnknownOIDCProvider
+	}
+	return provider, nil
+}
+
+func (p *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	wellKnown := strings.TrimSuffix(p.cfg.IssuerURL, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(wellKnown, &discovery); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	if discovery.Issuer != p.cfg.IssuerURL {
+		return nil, fmt.Errorf("oidc discovery: issuer mismatch %q", discovery.Issuer)
+	}
+
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// key returns the provider key for kid, refetching the key set when the kid
+// is unknown so provider rotations are picked up, though not more than once
+// every oidcJWKSMinRefetch
+func (p *oidcProvider) key(kid string) (interface{}, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys[kid]
+	if ok && time.Since(p.keysFetchedAt) < oidcJWKSCacheTTL {
+		return key, nil
+	}
+	if time.Since(p.keysCheckedAt) < oidcJWKSMinRefetch {
+		if !ok {
+			return nil, ErrInvalidIDToken
+		}
+		return key, nil
+	}
+	p.keysCheckedAt = time.Now()
+
+	var jwks struct {
+		Keys []struct {
+			KeyID   string `json:"kid"`
+			KeyType string `json:"kty"`
+			Curve   string `json:"crv"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("oidc jwks: %w", err)
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range jwks.Keys {
+		switch jwk.KeyType {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[jwk.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Curve {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[jwk.KeyID] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, ErrInvalidIDToken
+	}
+	return key, nil
+}
+
+func getJSON(endpoint string, target interface{}) error {
+	resp, err := oidcHTTPClient.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", endpoint, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+// StartOIDCLogin prepares a PKCE protected authorization code request and
+// returns the provider url to send the browser to, along with the state the
+// browser has to bring back
+func StartOIDCLogin(db *sql.DB, providerName string) (string, string, error) {
+	return startOIDCFlow(db, providerName, "")
+}
+
+// StartOIDCReauthentication is StartOIDCLogin for a signed in user who has
+// to prove it's still them, the provider is asked to log them in again.
+// Accounts without a password confirm sensitive changes this way.
+func StartOIDCReauthentication(db *sql.DB, providerName, sessionID string) (string, string, error) {
+	return startOIDCFlow(db, providerName, sessionID)
+}
+
+func startOIDCFlow(db *sql.DB, providerName, reauthSessionID string) (string, string, error) {
+	provider, err := getOIDCProvider(providerName)
+	if err != nil {
+		return "", "", err
+	}
+
+	discovery, err := provider.getDiscovery()
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := generateToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := generateToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	codeVerifier, err := generateToken(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	var sessionID sql.NullString
+	if reauthSessionID != "" {
+		sessionID = sql.NullString{String: reauthSessionID, Valid: true}
+	}
+
+	now := time.Now()
+	query := `
+		INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, reauth_session_id, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	if _, err := db.Exec(query, hashToken(state), providerName, nonce, codeVerifier, sessionID, now, now.Add(oidcStateTTL)); err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+
+	scopes := provider.cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", provider.cfg.ClientID)
+	params.Set("redirect_uri", provider.cfg.RedirectURL)
+	params.Set("scope", strings.Join(scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	if sessionID.Valid {
+		params.Set("prompt", "login")
+		params.Set("max_age", "0")
+	}
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), state, nil
+}
+
+// CompleteOIDCLogin redeems the authorization code, verifies the id token
+// and logs in the matching user, linking or creating the account if needed.
+// For a flow started by StartOIDCReauthentication it only marks the session
+// as freshly reauthenticated.
+func CompleteOIDCLogin(db *sql.DB, providerName, state, code string, client models.ClientInfo) (*models.LoginResult, error) {
+	provider, err := getOIDCProvider(providerName)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce, codeVerifier string
+	var reauthSessionID sql.NullString
+	var expiresAt time.Time
+	query := "SELECT nonce, code_verifier, reauth_session_id, expires_at FROM oidc_login_states WHERE state_hash = ? AND provider = ? AND used_at IS NULL"
+	err = db.QueryRow(query, hashToken(state), providerName).Scan(&nonce, &codeVerifier, &reauthSessionID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidOIDCState
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, ErrInvalidOIDCState
+	}
+
+	result, err := db.Exec("UPDATE oidc_login_states SET used_at = ? WHERE state_hash = ? AND used_at IS NULL", time.Now(), hashToken(state))
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return nil, ErrInvalidOIDCState
+	}
+
+	idToken, err := provider.exchangeCode(code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := provider.verifyIDToken(idToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	if reauthSessionID.Valid {
+		if err := markSessionReauthenticated(db, providerName, reauthSessionID.String, claims); err != nil {
+			return nil, err
+		}
+		return &models.LoginResult{Reauthenticated: true}, nil
+	}
+
+	user, err := findOrLinkOIDCUser(db, providerName, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return completeLogin(db, user, client)
+}
+
+func (p *oidcProvider) exchangeCode(code, codeVerifier string) (string, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	if p.cfg.ClientSecret != "" {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+
+	resp, err := oidcHTTPClient.PostForm(discovery.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("oidc token response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("oidc token exchange failed: %s %s", body.Error, body.ErrorDescription)
+	}
+
+	return body.IDToken, nil
+}
+
+func (p *oidcProvider) verifyIDToken(idToken, nonce string) (jwt.MapClaims, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := p.key(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		// only accept the algorithm family that matches the key type
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, ErrInvalidIDToken
+			}
+		case *ecdsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+				return nil, ErrInvalidIDToken
+			}
+		}
+
+		return key, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidIDToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrInvalidIDToken
+	}
+
+	if iss, _ := claims["iss"].(string); iss != discovery.Issuer {
+		return nil, ErrInvalidIDToken
+	}
+	if !audienceContains(claims["aud"], p.cfg.ClientID) {
+		return nil, ErrInvalidIDToken
+	}
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, ErrInvalidIDToken
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, ErrInvalidIDToken
+	}
+
+	return claims, nil
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findOrLinkOIDCUser maps the provider identity to a user. Existing accounts
+// are only linked by email when the provider vouches for the address.
+func findOrLinkOIDCUser(db *sql.DB, providerName string, claims jwt.MapClaims) (*models.User, error) {
+	subject, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	emailVerified, _ := claims["email_verified"].(bool)
+
+	var userID int
+	err := db.QueryRow("SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?", providerName, subject).Scan(&userID)
+	if err == nil {
+		return GetUserByID(db, userID)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if email == "" {
+		return nil, ErrInvalidIDToken
+	}
+
+	err = db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
+	switch {
+	case err == nil:
+		if !emailVerified {
+			return nil, ErrOIDCEmailUnverified
+		}
+	case err == sql.ErrNoRows:
+		userID, err = createOIDCUser(db, claims, email, emailVerified)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	query := "INSERT INTO user_identities (provider, subject, user_id, email, created_at) VALUES (?, ?, ?, ?, ?)"
+	if _, err := db.Exec(query, providerName, subject, userID, email, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return GetUserByID(db, userID)
+}
+
+// markSessionReauthenticated checks that the provider just logged in the
+// identity linked to the session's user
+func markSessionReauthenticated(db *sql.DB, providerName, sessionID string, claims jwt.MapClaims) error {
+	// max_age=0 makes auth_time mandatory, and it has to be from this flow
+	authTime, ok := claims["auth_time"].(float64)
+	if !ok || time.Since(time.Unix(int64(authTime), 0)) > oidcStateTTL {
+		return ErrInvalidIDToken
+	}
+
+	subject, _ := claims["sub"].(string)
+	var linked int
+	query := `
+		SELECT COUNT(*)
+		FROM sessions s
+		JOIN user_identities i ON i.user_id = s.user_id AND i.provider = ? AND i.subject = ?
+		WHERE s.id = ? AND s.revoked_at IS NULL AND s.impersonator_id IS NULL
+	`
+	if err := db.QueryRow(query, providerName, subject, sessionID).Scan(&linked); err != nil {
+		return err
+	}
+	if linked == 0 {
+		return ErrOIDCWrongIdentity
+	}
+
+	_, err := db.Exec("UPDATE sessions SET reauthenticated_at = ? WHERE id = ?", time.Now(), sessionID)
+	return err
+}
+
+var nonUsernameChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// createOIDCUser registers an account without a password, the user can set
+// one later through the password reset flow. Until then sensitive account
+// changes are confirmed with StartOIDCReauthentication.
+func createOIDCUser(db *sql.DB, claims jwt.MapClaims, email string, emailVerified bool) (int, error) {
+	base, _ := claims["preferred_username"].(string)
+	if base == "" {
+		base, _, _ = strings.Cut(email, "@")
+	}
+	base = nonUsernameChars.ReplaceAllString(base, "")
+	if len(base) > 24 {
+		base = base[:24]
+	}
+	for len(base) < 3 {
+		base += "_"
+	}
+
+	username := base
+	for attempt := 0; ; attempt++ {
+		var taken int
+		err := db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username).Scan(&taken)
+		if err != nil {
+			return 0, err
+		}
+		if taken == 0 {
+			break
+		}
+		if attempt == 5 {
+			return 0, errors.New("could not pick a free username")
+		}
+		suffix, err := generateToken(2)
+		if err != nil {
+			return 0, err
+		}
+		username = base + "_" + suffix
+	}
+
+	picture, _ := claims["picture"].(string)
+	var verifiedAt sql.NullTime
+	if emailVerified {
+		verifiedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+
+	result, err := db.Exec("INSERT INTO users (username, email, password, photo_url, email_verified_at) VALUES (?, ?, '', ?, ?)", username, email, picture, verifiedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), err
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"natter-chat-go/models"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageLimit = 20
+	MaxPageLimit     = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks a position in a list sorted newest first by created_at and
+// then id, which keeps the order stable when timestamps tie
+type Cursor struct {
+	CreatedAt time.Time
+	ID        int
+	// Backward asks for the items before the position instead of after it
+	Backward bool
+}
+
+// Encode hides the cursor behind base64 so clients don't build their own
+func (c Cursor) Encode() string {
+	direction := "n"
+	if c.Backward {
+		direction = "p"
+	}
+	raw := fmt.Sprintf("%s|%d|%d", direction, c.CreatedAt.UnixNano(), c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeCursor(encoded string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "p") {
+		return nil, ErrInvalidCursor
+	}
+
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &Cursor{CreatedAt: time.Unix(0, nanos).UTC(), ID: id, Backward: parts[0] == "p"}, nil
+}
+
+// PageRequest asks for Limit items after (or before) Cursor, or for the
+// first page when Cursor is nil
+type PageRequest struct {
+	Cursor *Cursor
+	Limit  int
+}
+
+// keyset returns the condition, the order and the LIMIT for the page query.
+// One extra row is fetched to tell whether there is more.
+func (p PageRequest) keyset(createdColumn, idColumn string) (string, string, []interface{}) {
+	if p.Cursor == nil {
+		return "1 = 1", createdColumn + " DESC, " + idColumn + " DESC", []interface{}{p.Limit + 1}
+	}
+
+	operator, direction := "<", "DESC"
+	if p.Cursor.Backward {
+		operator, direction = ">", "ASC"
+	}
+
+	condition := fmt.Sprintf("(%[1]s %[3]s ? OR (%[1]s = ? AND %[2]s %[3]s ?))", createdColumn, idColumn, operator)
+	order := createdColumn + " " + direction + ", " + idColumn + " " + direction
+	return condition, order, []interface{}{p.Cursor.CreatedAt, p.Cursor.CreatedAt, p.Cursor.ID, p.Limit + 1}
+}
+
+// paginate drops the extra row, puts backward pages back in newest first
+// order and works out the cursors around the page
+func paginate[T any](items []T, p PageRequest, key func(T) (time.Time, int)) ([]T, models.PageInfo) {
+	info := models.PageInfo{Limit: p.Limit}
+	backward := p.Cursor != nil && p.Cursor.Backward
+
+	hasMore := len(items) > p.Limit
+	if hasMore {
+		items = items[:p.Limit]
+	}
+	if backward {
+		slices.Reverse(items)
+	}
+
+	if len(items) == 0 {
+		// ran off one end, offer the way back
+		if p.Cursor != nil {
+			turned := *p.Cursor
+			turned.Backward = !backward
+			if backward {
+				info.NextCursor = turned.Encode()
+			} else {
+				info.PrevCursor = turned.Encode()
+			}
+		}
+		return items, info
+	}
+
+	cursorAt := func(item T, backward bool) string {
+		createdAt, id := key(item)
+		return Cursor{CreatedAt: createdAt, ID: id, Backward: backward}.Encode()
+	}
+
+	first, last := items[0], items[len(items)-1]
+	if backward {
+		if hasMore {
+			info.PrevCursor = cursorAt(first, true)
+		}
+		info.NextCursor = cursorAt(last, false)
+	} else {
+		if hasMore {
+			info.NextCursor = cursorAt(last, false)
+		}
+		if p.Cursor != nil {
+			info.PrevCursor = cursorAt(first, true)
+		}
+	}
+
+	return items, info
+}
+
+// parseTimestamp reads back a DATETIME the driver scanned into a string
+func parseTimestamp(value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		parsed, _ = time.Parse("2006-01-02 15:04:05", value)
+	}
+	return parsed
+}
+
+func postKey(post models.Post) (time.Time, int) {
+	return parseTimestamp(post.CreatedAt), post.ID
+}
@@ -0,0 +1,296 @@
+package services
+
+import (
+	"encoding/base64"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type pageItem struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+func pageItemKey(item pageItem) (time.Time, int) {
+	return item.CreatedAt, item.ID
+}
+
+// fetchPage does what the keyset query does in the database: filter by the
+// cursor, sort in the cursor's direction and take one extra row
+func fetchPage(all []pageItem, p PageRequest) []pageItem {
+	rows := []pageItem{}
+	for _, item := range all {
+		if p.Cursor == nil {
+			rows = append(rows, item)
+			continue
+		}
+		older := item.CreatedAt.Before(p.Cursor.CreatedAt) || (item.CreatedAt.Equal(p.Cursor.CreatedAt) && item.ID < p.Cursor.ID)
+		newer := item.CreatedAt.After(p.Cursor.CreatedAt) || (item.CreatedAt.Equal(p.Cursor.CreatedAt) && item.ID > p.Cursor.ID)
+		if (!p.Cursor.Backward && older) || (p.Cursor.Backward && newer) {
+			rows = append(rows, item)
+		}
+	}
+
+	slices.SortFunc(rows, func(a, b pageItem) int {
+		order := b.CreatedAt.Compare(a.CreatedAt)
+		if order == 0 {
+			order = b.ID - a.ID
+		}
+		if p.Cursor != nil && p.Cursor.Backward {
+			order = -order
+		}
+		return order
+	})
+
+	if len(rows) > p.Limit+1 {
+		rows = rows[:p.Limit+1]
+	}
+	return rows
+}
+
+func ids(items []pageItem) []int {
+	result := make([]int, len(items))
+	for i, item := range items {
+		result[i] = item.ID
+	}
+	return result
+}
+
+func mustDecode(t *testing.T, encoded string) *Cursor {
+	t.Helper()
+	cursor, err := DecodeCursor(encoded)
+	if err != nil {
+		t.Fatalf("DecodeCursor(%q): %v", encoded, err)
+	}
+	return cursor
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor Cursor
+	}{
+		{"forward", Cursor{CreatedAt: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC), ID: 42}},
+		{"backward", Cursor{CreatedAt: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC), ID: 42, Backward: true}},
+		{"nanoseconds", Cursor{CreatedAt: time.Date(2023, 1, 2, 3, 4, 5, 123456789, time.UTC), ID: 1}},
+		{"zero id", Cursor{CreatedAt: time.Unix(0, 0).UTC(), ID: 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := tt.cursor.Encode()
+			if strings.Contains(encoded, "=") {
+				t.Errorf("Encode() = %q, cursors must not carry base64 padding", encoded)
+			}
+			decoded := mustDecode(t, encoded)
+			if !decoded.CreatedAt.Equal(tt.cursor.CreatedAt) || decoded.ID != tt.cursor.ID || decoded.Backward != tt.cursor.Backward {
+				t.Errorf("round trip = %+v, want %+v", *decoded, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorRejectsInvalidInput(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"empty", ""},
+		{"not base64", "!!!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte("n|1|1"))},
+		{"too few parts", encode("n|1")},
+		{"too many parts", encode("n|1|1|1")},
+		{"unknown direction", encode("x|1|1")},
+		{"bad timestamp", encode("n|soon|1")},
+		{"bad id", encode("n|1|one")},
+		{"timestamp overflow", encode("n|99999999999999999999|1")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if cursor, err := DecodeCursor(tt.encoded); err != ErrInvalidCursor {
+				t.Errorf("DecodeCursor(%q) = %+v, %v, want ErrInvalidCursor", tt.encoded, cursor, err)
+			}
+		})
+	}
+}
+
+func TestKeyset(t *testing.T) {
+	at := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		page      PageRequest
+		condition string
+		order     string
+		args      []interface{}
+	}{
+		{
+			name:      "first page",
+			page:      PageRequest{Limit: 10},
+			condition: "1 = 1",
+			order:     "p.created_at DESC, p.id DESC",
+			args:      []interface{}{11},
+		},
+		{
+			name:      "forward",
+			page:      PageRequest{Cursor: &Cursor{CreatedAt: at, ID: 7}, Limit: 10},
+			condition: "(p.created_at < ? OR (p.created_at = ? AND p.id < ?))",
+			order:     "p.created_at DESC, p.id DESC",
+			args:      []interface{}{at, at, 7, 11},
+		},
+		{
+			name:      "backward",
+			page:      PageRequest{Cursor: &Cursor{CreatedAt: at, ID: 7, Backward: true}, Limit: 10},
+			condition: "(p.created_at > ? OR (p.created_at = ? AND p.id > ?))",
+			order:     "p.created_at ASC, p.id ASC",
+			args:      []interface{}{at, at, 7, 11},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition, order, args := tt.page.keyset("p.created_at", "p.id")
+			if condition != tt.condition {
+				t.Errorf("condition = %q, want %q", condition, tt.condition)
+			}
+			if order != tt.order {
+				t.Errorf("order = %q, want %q", order, tt.order)
+			}
+			if len(args) != len(tt.args) {
+				t.Fatalf("args = %v, want %v", args, tt.args)
+			}
+			for i := range args {
+				if got, ok := args[i].(time.Time); ok {
+					if !got.Equal(tt.args[i].(time.Time)) {
+						t.Errorf("args[%d] = %v, want %v", i, args[i], tt.args[i])
+					}
+				} else if args[i] != tt.args[i] {
+					t.Errorf("args[%d] = %v, want %v", i, args[i], tt.args[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	base := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	// newest first: 5 and 4 share a timestamp, as do 2 and 1
+	all := []pageItem{
+		{base.Add(3 * time.Minute), 5},
+		{base.Add(3 * time.Minute), 4},
+		{base.Add(2 * time.Minute), 3},
+		{base.Add(time.Minute), 2},
+		{base.Add(time.Minute), 1},
+	}
+
+	tests := []struct {
+		name     string
+		source   []pageItem
+		cursor   *Cursor
+		limit    int
+		want     []int
+		wantNext bool
+		wantPrev bool
+	}{
+		{"first page", all, nil, 2, []int{5, 4}, true, false},
+		{"everything fits", all, nil, 10, []int{5, 4, 3, 2, 1}, false, false},
+		{"exactly full", all, nil, 5, []int{5, 4, 3, 2, 1}, false, false},
+		{"after a tie", all, &Cursor{CreatedAt: all[0].CreatedAt, ID: 5}, 2, []int{4, 3}, true, true},
+		{"last page", all, &Cursor{CreatedAt: all[2].CreatedAt, ID: 3}, 2, []int{2, 1}, false, true},
+		{"before the end", all, &Cursor{CreatedAt: all[4].CreatedAt, ID: 1, Backward: true}, 2, []int{3, 2}, true, true},
+		{"back to the start", all, &Cursor{CreatedAt: all[2].CreatedAt, ID: 3, Backward: true}, 2, []int{5, 4}, true, false},
+		{"ran off the end", all, &Cursor{CreatedAt: all[4].CreatedAt, ID: 1}, 2, []int{}, false, true},
+		{"ran off the start", all, &Cursor{CreatedAt: all[0].CreatedAt, ID: 5, Backward: true}, 2, []int{}, true, false},
+		{"empty list", nil, nil, 2, []int{}, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := PageRequest{Cursor: tt.cursor, Limit: tt.limit}
+			items, info := paginate(fetchPage(tt.source, page), page, pageItemKey)
+
+			if got := ids(items); !slices.Equal(got, tt.want) {
+				t.Errorf("items = %v, want %v", got, tt.want)
+			}
+			if info.Limit != tt.limit {
+				t.Errorf("limit = %d, want %d", info.Limit, tt.limit)
+			}
+			if (info.NextCursor != "") != tt.wantNext {
+				t.Errorf("next cursor = %q, want one: %v", info.NextCursor, tt.wantNext)
+			}
+			if (info.PrevCursor != "") != tt.wantPrev {
+				t.Errorf("prev cursor = %q, want one: %v", info.PrevCursor, tt.wantPrev)
+			}
+			if info.NextCursor != "" && mustDecode(t, info.NextCursor).Backward {
+				t.Errorf("next cursor points backward")
+			}
+			if info.PrevCursor != "" && !mustDecode(t, info.PrevCursor).Backward {
+				t.Errorf("prev cursor points forward")
+			}
+		})
+	}
+}
+
+// following the cursors both ways has to visit every item once, in order
+func TestPaginateWalksBothWays(t *testing.T) {
+	base := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	all := []pageItem{}
+	for id := 10; id >= 1; id-- {
+		// pairs of items share a timestamp
+		all = append(all, pageItem{base.Add(time.Duration(id/2) * time.Second), id})
+	}
+
+	for _, limit := range []int{1, 3, 4, 10} {
+		page := PageRequest{Limit: limit}
+		forward := [][]int{}
+		var prevCursors []string
+		for {
+			items, info := paginate(fetchPage(all, page), page, pageItemKey)
+			forward = append(forward, ids(items))
+			prevCursors = append(prevCursors, info.PrevCursor)
+			if info.NextCursor == "" {
+				break
+			}
+			page = PageRequest{Cursor: mustDecode(t, info.NextCursor), Limit: limit}
+			if len(forward) > len(all) {
+				t.Fatalf("limit %d: forward walk doesn't end", limit)
+			}
+		}
+
+		visited := slices.Concat(forward...)
+		if !slices.Equal(visited, ids(all)) {
+			t.Errorf("limit %d: forward walk = %v, want %v", limit, visited, ids(all))
+		}
+
+		// walk back from the last page with the prev cursors
+		for i := len(forward) - 1; i > 0; i-- {
+			page := PageRequest{Cursor: mustDecode(t, prevCursors[i]), Limit: limit}
+			items, info := paginate(fetchPage(all, page), page, pageItemKey)
+			if !slices.Equal(ids(items), forward[i-1]) {
+				t.Errorf("limit %d: page %d walking back = %v, want %v", limit, i-1, ids(items), forward[i-1])
+			}
+			if (info.PrevCursor == "") != (i-1 == 0) {
+				t.Errorf("limit %d: page %d walking back has prev cursor %q", limit, i-1, info.PrevCursor)
+			}
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2024, 5, 1, 12, 30, 15, 0, time.UTC)
+	for _, value := range []string{"2024-05-01T12:30:15Z", "2024-05-01 12:30:15"} {
+		if got := parseTimestamp(value); !got.Equal(want) {
+			t.Errorf("parseTimestamp(%q) = %v, want %v", value, got, want)
+		}
+	}
+	if got := parseTimestamp("yesterday"); !got.IsZero() {
+		t.Errorf("parseTimestamp of garbage = %v, want zero time", got)
+	}
+}
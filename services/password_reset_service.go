@@ -0,0 +1,122 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"natter-chat-go/mailer"
+	"net/url"
+	"time"
+)
+
+const (
+	passwordResetTokenTTL = time.Hour
+	passwordResetCooldown = time.Minute
+)
+
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// RequestPasswordReset emails a reset link when the email belongs to an
+// account. It never reports whether it does.
+func RequestPasswordReset(db *sql.DB, email string) error {
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// silently drop requests that come too fast
+	var lastRequested sql.NullTime
+	err = db.QueryRow("SELECT MAX(created_at) FROM password_reset_tokens WHERE user_id = ?", userID).Scan(&lastRequested)
+	if err != nil {
+		return err
+	}
+	if lastRequested.Valid && time.Since(lastRequested.Time) < passwordResetCooldown {
+		return nil
+	}
+
+	token, err := generateToken(32)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = db.Exec("INSERT INTO password_reset_tokens (user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)", userID, hashToken(token), now, now.Add(passwordResetTokenTTL))
+	if err != nil {
+		return err
+	}
+
+	link := appConfig.AppBaseURL + "/reset-password?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      email,
+		Subject: "Reset your Natter password",
+		Body:    "Someone asked to reset the password of your Natter account.\n\nChoose a new password here:\n\n" + link + "\n\nThe link expires in 1 hour. If it wasn't you, ignore this email.\n",
+	}
+
+	// sending in the background keeps the response time the same for known
+	// and unknown emails
+	go func() {
+		if err := mailSender.Send(msg); err != nil {
+			log.Printf("sending password reset email to user %d: %v", userID, err)
+		}
+	}()
+
+	return nil
+}
+
+// ResetPassword consumes a reset token, sets the new password and signs the
+// user out of every session
+func ResetPassword(db *sql.DB, token, newPassword string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var tokenID, userID int
+	var expiresAt time.Time
+	query := "SELECT id, user_id, expires_at FROM password_reset_tokens WHERE token_hash = ? AND used_at IS NULL FOR UPDATE"
+	err = tx.QueryRow(query, hashToken(token)).Scan(&tokenID, &userID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	if time.Now().After(expiresAt) {
+		return ErrInvalidResetToken
+	}
+
+	var username, email string
+	if err := tx.QueryRow("SELECT username, email FROM users WHERE id = ?", userID).Scan(&username, &email); err != nil {
+		return err
+	}
+
+	if err := ValidatePassword(newPassword, username, email); err != nil {
+		return err
+	}
+
+	hashedPassword, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET password = ? WHERE id = ?", hashedPassword, userID); err != nil {
+		return err
+	}
+
+	// burn this token and any other outstanding one
+	if _, err := tx.Exec("UPDATE password_reset_tokens SET used_at = ? WHERE user_id = ? AND used_at IS NULL", time.Now(), userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", time.Now(), userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
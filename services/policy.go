@@ -0,0 +1,73 @@
+package services
+
+import (
+	"database/sql"
+	"natter-chat-go/models"
+)
+
+// PolicyError is returned when the actor is not allowed to perform an action
+type PolicyError struct {
+	Action string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return "not allowed to " + e.Action + ": " + e.Reason
+}
+
+// only the author may edit a post
+func authorizePostUpdate(db *sql.DB, actor models.Actor, postID int) error {
+	authorID, err := getPostAuthorID(db, postID)
+	if err != nil {
+		return err
+	}
+
+	if actor.UserID != authorID {
+		return &PolicyError{Action: "update post", Reason: "not the author"}
+	}
+
+	return nil
+}
+
+// the author or someone allowed to moderate posts may delete a post
+func authorizePostDelete(db *sql.DB, actor models.Actor, postID int) error {
+	authorID, err := getPostAuthorID(db, postID)
+	if err != nil {
+		return err
+	}
+
+	if actor.UserID != authorID && !actor.HasPermission(PermModeratePosts) {
+		return &PolicyError{Action: "delete post", Reason: "not the author or a moderator"}
+	}
+
+	return nil
+}
+
+// the comment author, the owner of the post it was made on or someone allowed
+// to moderate comments may delete a comment
+func authorizeCommentDelete(db *sql.DB, actor models.Actor, commentID int) error {
+	var authorID, postOwnerID int
+	query := `
+		SELECT c.user_id, p.user_id
+		FROM comments c
+		JOIN posts p ON p.id = c.post_id
+		WHERE c.id = ? AND c.deleted_at IS NULL
+	`
+
+	err := db.QueryRow(query, commentID).Scan(&authorID, &postOwnerID)
+	if err != nil {
+		return err
+	}
+
+	if actor.UserID != authorID && actor.UserID != postOwnerID && !actor.HasPermission(PermModerateComments) {
+		return &PolicyError{Action: "delete comment", Reason: "not the author, the post owner or a moderator"}
+	}
+
+	return nil
+}
+
+func getPostAuthorID(db *sql.DB, postID int) (int, error) {
+	var authorID int
+	err := db.QueryRow("SELECT user_id FROM posts WHERE id = ?", postID).Scan(&authorID)
+	return authorID, err
+}
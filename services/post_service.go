@@ -12,7 +12,7 @@ func scanPost(rows *sql.Rows) (models.Post, error) {
 	var post models.Post
 	var photoURLs string
 
-	err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.CreatedAt, &post.UserID, &photoURLs, &post.CommentCount)
+	err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.CreatedAt, &post.UserID, &post.Visibility, &photoURLs, &post.CommentCount)
 	if err != nil {
 		return post, err
 	}
@@ -43,40 +43,100 @@ func populatePostDetails(db *sql.DB, post *models.Post) error {
 	return nil
 }
 
-func GetPosts(db *sql.DB) ([]models.Post, error) {
-	var posts []models.Post
+// GetPosts pages through every post the viewer may see and hasn't blocked
+// or muted, newest first
+func GetPosts(db *sql.DB, viewerID int, page PageRequest) ([]models.Post, models.PageInfo, error) {
+	where, args := authorFilter("p.user_id", viewerID, true)
+	return listPosts(db, viewerID, "", where, args, page)
+}
+
+// listPosts runs a keyset paginated post query. join and where narrow the
+// posts down, args fill their placeholders in the order they appear. Posts
+// the viewer may not see are always left out.
+func listPosts(db *sql.DB, viewerID int, join, where string, args []interface{}, page PageRequest) ([]models.Post, models.PageInfo, error) {
+	condition, order, pageArgs := page.keyset("p.created_at", "p.id")
+	visible, visibleArgs := visibilityFilter("p", viewerID, true)
 
 	query := `
-		SELECT p.id, p.title, p.content, p.created_at, p.user_id, 
+		SELECT p.id, p.title, p.content, p.created_at, p.user_id, p.visibility,
 		       COALESCE(GROUP_CONCAT(ph.url), '') AS photo_urls,
-		       (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id) AS comment_count
+		       (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id AND c.deleted_at IS NULL) AS comment_count
 		FROM posts p
+		` + join + `
 		LEFT JOIN photos ph ON p.id = ph.post_id
+		WHERE ` + where + ` AND ` + visible + ` AND ` + condition + `
 		GROUP BY p.id
-		ORDER BY p.created_at DESC
+		ORDER BY ` + order + `
+		LIMIT ?
 	`
 
-	rows, err := db.Query(query)
+	args = append(append(args, visibleArgs...), pageArgs...)
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, models.PageInfo{}, err
 	}
 	defer rows.Close()
 
+	posts := []models.Post{}
 	for rows.Next() {
 		post, err := scanPost(rows)
 		if err != nil {
-			return nil, err
+			return nil, models.PageInfo{}, err
 		}
+		posts = append(posts, post)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, models.PageInfo{}, err
+	}
 
-		err = populatePostDetails(db, &post)
-		if err != nil {
-			return nil, err
+	hidden, err := hiddenUserIDs(db, viewerID)
+	if err != nil {
+		return nil, models.PageInfo{}, err
+	}
+
+	posts, info := paginate(posts, page, postKey)
+	for i := range posts {
+		if err := populatePostDetails(db, &posts[i]); err != nil {
+			return nil, models.PageInfo{}, err
 		}
+		posts[i].LikedBy = filterUserIDs(posts[i].LikedBy, hidden)
+	}
 
-		posts = append(posts, post)
+	return posts, info, nil
+}
+
+// GetVisiblePost returns the post unless its visibility keeps it from the
+// viewer or the author and the viewer blocked each other, in which case it
+// doesn't exist for the viewer
+func GetVisiblePost(db *sql.DB, viewerID, id int) (*models.Post, error) {
+	post, err := GetPostByID(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, err := canViewPost(db, viewerID, post)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, sql.ErrNoRows
 	}
 
-	return posts, nil
+	blocked, err := isBlockedEitherWay(db, viewerID, post.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if blocked {
+		return nil, sql.ErrNoRows
+	}
+
+	hidden, err := hiddenUserIDs(db, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	post.LikedBy = filterUserIDs(post.LikedBy, hidden)
+
+	return post, nil
 }
 
 func GetPostByID(db *sql.DB, id int) (*models.Post, error) {
@@ -94,11 +154,11 @@ func GetPostByID(db *sql.DB, id int) (*models.Post, error) {
 		comment_counts AS (
 			SELECT p.id, COUNT(c.id) AS comment_count
 			FROM posts p
-			LEFT JOIN comments c ON p.id = c.post_id
+			LEFT JOIN comments c ON p.id = c.post_id AND c.deleted_at IS NULL
 			WHERE p.id = ?
 			GROUP BY p.id
 		)
-		SELECT p.id, p.title, p.content, p.created_at, p.user_id, 
+		SELECT p.id, p.title, p.content, p.created_at, p.user_id, p.visibility,
 		       pu.photo_urls, cc.comment_count
 		FROM posts p
 		LEFT JOIN photo_urls pu ON p.id = pu.id
@@ -106,7 +166,7 @@ func GetPostByID(db *sql.DB, id int) (*models.Post, error) {
 		WHERE p.id = ?
 	`
 
-	err := db.QueryRow(query, id, id, id).Scan(&post.ID, &post.Title, &post.Content, &post.CreatedAt, &post.UserID, &photoURLs, &post.CommentCount)
+	err := db.QueryRow(query, id, id, id).Scan(&post.ID, &post.Title, &post.Content, &post.CreatedAt, &post.UserID, &post.Visibility, &photoURLs, &post.CommentCount)
 	if err != nil {
 		return nil, err
 	}
@@ -125,65 +185,30 @@ func GetPostByID(db *sql.DB, id int) (*models.Post, error) {
 	return &post, nil
 }
 
-func GetPostsByUserID(db *sql.DB, userID int) ([]models.Post, error) {
-	var posts []models.Post
-
-	query := `
-		WITH photo_urls AS (
-			SELECT p.id, COALESCE(GROUP_CONCAT(ph.url), '') AS photo_urls
-			FROM posts p
-			LEFT JOIN photos ph ON p.id = ph.post_id
-			GROUP BY p.id
-		),
-		comment_counts AS (
-			SELECT p.id, COUNT(c.id) AS comment_count
-			FROM posts p
-			LEFT JOIN comments c ON p.id = c.post_id
-			GROUP BY p.id
-		)
-		SELECT p.id, p.title, p.content, p.created_at, p.user_id, 
-		       pu.photo_urls, cc.comment_count
-		FROM posts p
-		LEFT JOIN photo_urls pu ON p.id = pu.id
-		LEFT JOIN comment_counts cc ON p.id = cc.id
-		WHERE p.user_id = ?
-		ORDER BY p.created_at DESC
-	`
-
-	rows, err := db.Query(query, userID)
+// GetPostsByUserID pages through the posts of one user, newest first
+func GetPostsByUserID(db *sql.DB, viewerID, userID int, page PageRequest) ([]models.Post, models.PageInfo, error) {
+	blocked, err := isBlockedEitherWay(db, viewerID, userID)
 	if err != nil {
-		return nil, err
+		return nil, models.PageInfo{}, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var post models.Post
-		var photoURLs string
-
-		err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.CreatedAt, &post.UserID, &photoURLs, &post.CommentCount)
-		if err != nil {
-			return nil, err
-		}
-
-		if photoURLs != "" {
-			post.PhotoURLs = strings.Split(photoURLs, ",")
-		} else {
-			post.PhotoURLs = []string{}
-		}
-
-		err = populatePostDetails(db, &post)
-		if err != nil {
-			return nil, err
-		}
-
-		posts = append(posts, post)
+	if blocked {
+		// same as a missing account, so the block isn't revealed
+		return nil, models.PageInfo{}, sql.ErrNoRows
 	}
 
-	return posts, nil
+	return listPosts(db, viewerID, "", "p.user_id = ?", []interface{}{userID}, page)
 }
 
 func CreatePost(db *sql.DB, post models.CreatePostRequest) (*models.Post, error) {
-	result, err := db.Exec("INSERT INTO posts (title, content, created_at, user_id) VALUES (?, ?, ?, ?)", post.Title, post.Content, time.Now(), post.UserID)
+	if post.Visibility == "" {
+		post.Visibility = PostPublic
+	}
+	if err := validatePostVisibility(post.Visibility); err != nil {
+		return nil, err
+	}
+
+	query := "INSERT INTO posts (title, content, created_at, user_id, visibility) VALUES (?, ?, ?, ?, ?)"
+	result, err := db.Exec(query, post.Title, post.Content, time.Now(), post.UserID, post.Visibility)
 	if err != nil {
 		return &models.Post{}, err
 	}
@@ -200,10 +225,22 @@ func CreatePost(db *sql.DB, post models.CreatePostRequest) (*models.Post, error)
 		}
 	}
 
+	fanOutPost(db, int(lastInsertId), post.UserID)
+
 	return GetPostByID(db, int(lastInsertId))
 }
 
-func UpdatePost(db *sql.DB, post models.CreatePostRequest, postID int) (*models.Post, error) {
+func UpdatePost(db *sql.DB, actor models.Actor, post models.CreatePostRequest, postID int) (*models.Post, error) {
+	if err := authorizePostUpdate(db, actor, postID); err != nil {
+		return nil, err
+	}
+
+	if post.Visibility != "" {
+		if err := validatePostVisibility(post.Visibility); err != nil {
+			return nil, err
+		}
+	}
+
 	// update photos (delete all photos and insert the new ones)
 	if len(post.PhotoURLs) > 0 {
 		_, err := db.Exec("DELETE FROM photos WHERE post_id = ?", postID)
@@ -219,7 +256,8 @@ func UpdatePost(db *sql.DB, post models.CreatePostRequest, postID int) (*models.
 		}
 
 	}
-	_, err := db.Exec("UPDATE posts SET title = ?, content = ? WHERE id = ?", post.Title, post.Content, postID)
+	query := "UPDATE posts SET title = ?, content = ?, visibility = COALESCE(NULLIF(?, ''), visibility) WHERE id = ?"
+	_, err := db.Exec(query, post.Title, post.Content, post.Visibility, postID)
 	if err != nil {
 		return &models.Post{}, err
 	}
@@ -227,7 +265,11 @@ func UpdatePost(db *sql.DB, post models.CreatePostRequest, postID int) (*models.
 	return GetPostByID(db, postID)
 }
 
-func DeletePost(db *sql.DB, id int) (int64, error) {
+func DeletePost(db *sql.DB, actor models.Actor, id int) (int64, error) {
+	if err := authorizePostDelete(db, actor, id); err != nil {
+		return 0, err
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
 		return 0, err
@@ -240,35 +282,42 @@ func DeletePost(db *sql.DB, id int) (int64, error) {
 		}
 	}()
 
-	// delete photos
-	if _, err := tx.Exec("DELETE FROM photos WHERE post_id = ?", id); err != nil {
+	result, err := deletePostTx(tx, id)
+	if err != nil {
 		tx.Rollback()
 		return 0, err
 	}
 
+	// commit transaction
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// deletePostTx removes a post together with its photos, likes and comments
+func deletePostTx(tx *sql.Tx, id int) (sql.Result, error) {
+	// delete photos
+	if _, err := tx.Exec("DELETE FROM photos WHERE post_id = ?", id); err != nil {
+		return nil, err
+	}
+
 	// delete likes
 	if _, err := tx.Exec("DELETE FROM post_likes WHERE post_id = ?", id); err != nil {
-		tx.Rollback()
-		return 0, err
+		return nil, err
 	}
 
 	// delete comments
 	if _, err := tx.Exec("DELETE FROM comments WHERE post_id = ?", id); err != nil {
-		tx.Rollback()
-		return 0, err
-	}
-
-	// delete post
-	result, err := tx.Exec("DELETE FROM posts WHERE id = ?", id)
-	if err != nil {
-		tx.Rollback()
-		return 0, err
+		return nil, err
 	}
 
-	// commit transaction
-	if err := tx.Commit(); err != nil {
-		return 0, err
+	// take it off every home timeline
+	if _, err := tx.Exec("DELETE FROM home_timeline WHERE post_id = ?", id); err != nil {
+		return nil, err
 	}
 
-	return result.RowsAffected()
+	// delete post
+	return tx.Exec("DELETE FROM posts WHERE id = ?", id)
 }
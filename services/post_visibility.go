@@ -0,0 +1,76 @@
+package services
+
+import (
+	"database/sql"
+	"natter-chat-go/models"
+)
+
+const (
+	// PostPublic posts show up everywhere
+	PostPublic = "public"
+	// PostFollowers posts are only shown to the author's accepted followers
+	PostFollowers = "followers"
+	// PostPrivate posts are only shown to the author
+	PostPrivate = "private"
+	// PostUnlisted posts can be opened by anyone with the link but stay out
+	// of every list except the author's own
+	PostUnlisted = "unlisted"
+)
+
+func validatePostVisibility(visibility string) error {
+	switch visibility {
+	case PostPublic, PostFollowers, PostPrivate, PostUnlisted:
+		return nil
+	}
+	return &ValidationError{Fields: map[string]string{"visibility": "must be public, followers, private or unlisted"}}
+}
+
+// visibilityFilter builds the condition that keeps posts the viewer may not
+// see out of a query on the posts table aliased as alias. Listed queries
+// leave unlisted posts out as well, unless the viewer wrote them.
+func visibilityFilter(alias string, viewerID int, listed bool) (string, []interface{}) {
+	open := alias + ".visibility IN ('" + PostPublic + "', '" + PostUnlisted + "')"
+	if listed {
+		open = alias + ".visibility = '" + PostPublic + "'"
+	}
+
+	if viewerID == 0 {
+		return open, nil
+	}
+
+	condition := "(" + alias + ".user_id = ? OR " + open + " OR (" + alias + ".visibility = '" + PostFollowers + "' AND " +
+		alias + ".user_id IN (SELECT followee_id FROM follows WHERE follower_id = ? AND status = 'accepted')))"
+	return condition, []interface{}{viewerID, viewerID}
+}
+
+// canViewPost reports whether the viewer may open the post directly
+func canViewPost(db *sql.DB, viewerID int, post *models.Post) (bool, error) {
+	switch post.Visibility {
+	case PostPublic, PostUnlisted:
+		return true, nil
+	case PostFollowers:
+		return canSeePrivateContent(db, viewerID, post.UserID)
+	default:
+		return viewerID == post.UserID, nil
+	}
+}
+
+// authorizePostView hides a post the viewer may not see as if it didn't
+// exist, so guessed ids don't reveal anything
+func authorizePostView(db *sql.DB, viewerID, postID int) error {
+	var post models.Post
+	err := db.QueryRow("SELECT user_id, visibility FROM posts WHERE id = ?", postID).Scan(&post.UserID, &post.Visibility)
+	if err != nil {
+		return err
+	}
+
+	allowed, err := canViewPost(db, viewerID, &post)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
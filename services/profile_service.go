@@ -0,0 +1,242 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"natter-chat-go/models"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	usernameChangeCooldown = 30 * 24 * time.Hour
+	// how long an old username stays reserved for its previous owner
+	usernameReservation = 90 * 24 * time.Hour
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,30}$`)
+
+// ValidationError maps each invalid field to what is wrong with it
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for field, problem := range e.Fields {
+		fields = append(fields, field+": "+problem)
+	}
+	sort.Strings(fields)
+	return "validation failed: " + strings.Join(fields, "; ")
+}
+
+func GetProfileByID(db *sql.DB, viewerID, userID int) (*models.Profile, error) {
+	return getProfile(db, viewerID, "u.id = ?", userID)
+}
+
+func GetProfileByUsername(db *sql.DB, viewerID int, username string) (*models.Profile, error) {
+	return getProfile(db, viewerID, "u.username = ?", username)
+}
+
+// getProfile counts only the posts the viewer would find listed on the
+// profile, so hidden ones don't show up in post_count either
+func getProfile(db *sql.DB, viewerID int, where string, arg interface{}) (*models.Profile, error) {
+	var profile models.Profile
+	var joinedAt time.Time
+
+	visible, visibleArgs := visibilityFilter("p", viewerID, true)
+	query := `
+		SELECT u.id, u.username, u.display_name, u.bio, u.location, u.website,
+		       COALESCE(u.photo_url, ''), u.banner_url, u.created_at,
+		       (SELECT COUNT(*) FROM posts p WHERE p.user_id = u.id AND ` + visible + `) AS post_count,
+		       (SELECT COUNT(*) FROM follows f WHERE f.followee_id = u.id AND f.status = 'accepted') AS follower_count,
+		       (SELECT COUNT(*) FROM follows f WHERE f.follower_id = u.id AND f.status = 'accepted') AS following_count,
+		       u.is_private
+		FROM users u
+		WHERE ` + where
+
+	args := append(visibleArgs, arg)
+	err := db.QueryRow(query, args...).Scan(&profile.ID, &profile.Username, &profile.DisplayName, &profile.Bio, &profile.Location, &profile.Website,
+		&profile.Photo, &profile.BannerURL, &joinedAt, &profile.PostCount, &profile.FollowerCount, &profile.FollowingCount, &profile.IsPrivate)
+	if err != nil {
+		return nil, err
+	}
+
+	profile.JoinedAt = joinedAt.Format(time.RFC3339)
+	return &profile, nil
+}
+
+// ResolveOldUsername returns the current username of the account that used
+// to be called username, or sql.ErrNoRows
+func ResolveOldUsername(db *sql.DB, username string) (string, error) {
+	var current string
+	query := `
+		SELECT u.username
+		FROM username_history h
+		JOIN users u ON u.id = h.user_id
+		WHERE h.old_username = ?
+	`
+	err := db.QueryRow(query, username).Scan(&current)
+	return current, err
+}
+
+// UpdateProfile applies the fields present in the request
+func UpdateProfile(db *sql.DB, userID int, request models.UpdateProfileRequest) (*models.Profile, error) {
+	current, err := GetProfileByID(db, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := map[string]string{}
+	checkLength := func(field string, value *string, max int) {
+		if value != nil && utf8.RuneCountInString(*value) > max {
+			problems[field] = fmt.Sprintf("must be at most %d characters", max)
+		}
+	}
+	checkURL := func(field string, value *string, max int) {
+		if value == nil || *value == "" {
+			return
+		}
+		parsed, err := url.Parse(*value)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems[field] = "must be an http or https url"
+		} else if len(*value) > max {
+			problems[field] = fmt.Sprintf("must be at most %d characters", max)
+		}
+	}
+
+	trim := func(value *string) {
+		if value != nil {
+			*value = strings.TrimSpace(*value)
+		}
+	}
+	trim(request.Username)
+	trim(request.DisplayName)
+	trim(request.Bio)
+	trim(request.Location)
+	trim(request.Website)
+
+	checkLength("displayName", request.DisplayName, 50)
+	checkLength("bio", request.Bio, 160)
+	checkLength("location", request.Location, 30)
+	checkURL("website", request.Website, 100)
+	checkURL("photoUrl", request.Photo, 500)
+	checkURL("bannerUrl", request.BannerURL, 500)
+
+	usernameChanged := request.Username != nil && *request.Username != current.Username
+	if usernameChanged {
+		if problem, err := checkUsernameChange(db, userID, *request.Username); err != nil {
+			return nil, err
+		} else if problem != "" {
+			problems["username"] = problem
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, &ValidationError{Fields: problems}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET display_name = COALESCE(?, display_name),
+		    bio = COALESCE(?, bio),
+		    location = COALESCE(?, location),
+		    website = COALESCE(?, website),
+		    photo_url = COALESCE(?, photo_url),
+		    banner_url = COALESCE(?, banner_url),
+		    is_private = COALESCE(?, is_private)
+		WHERE id = ?
+	`
+	_, err = tx.Exec(query, request.DisplayName, request.Bio, request.Location, request.Website, request.Photo, request.BannerURL, request.IsPrivate, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// going public lets everyone who asked in
+	var acceptedFollowers []int
+	if request.IsPrivate != nil && !*request.IsPrivate && current.IsPrivate {
+		acceptedFollowers, err = acceptPendingFollowRequests(tx, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if usernameChanged {
+		now := time.Now()
+		if _, err := tx.Exec("UPDATE users SET username = ?, username_changed_at = ? WHERE id = ?", *request.Username, now, userID); err != nil {
+			return nil, err
+		}
+
+		// taking back one of your own old names drops it from the history
+		if _, err := tx.Exec("DELETE FROM username_history WHERE old_username = ?", *request.Username); err != nil {
+			return nil, err
+		}
+
+		query := `
+			INSERT INTO username_history (old_username, user_id, changed_at)
+			VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), changed_at = VALUES(changed_at)
+		`
+		if _, err := tx.Exec(query, current.Username, userID, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for _, followerID := range acceptedFollowers {
+		backfillTimeline(db, followerID, userID)
+	}
+
+	return GetProfileByID(db, userID, userID)
+}
+
+// checkUsernameChange returns a problem description when the change is not
+// allowed
+func checkUsernameChange(db *sql.DB, userID int, username string) (string, error) {
+	if !usernamePattern.MatchString(username) {
+		return "must be 3 to 30 letters, digits or underscores", nil
+	}
+
+	var changedAt sql.NullTime
+	if err := db.QueryRow("SELECT username_changed_at FROM users WHERE id = ?", userID).Scan(&changedAt); err != nil {
+		return "", err
+	}
+	if changedAt.Valid && time.Since(changedAt.Time) < usernameChangeCooldown {
+		next := changedAt.Time.Add(usernameChangeCooldown).Format("2006-01-02")
+		return "can only be changed once every 30 days, next change allowed on " + next, nil
+	}
+
+	var taken int
+	err := db.QueryRow("SELECT id FROM users WHERE username = ? AND id <> ?", username, userID).Scan(&taken)
+	if err == nil {
+		return "is already taken", nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	var owner int
+	var releasedAt time.Time
+	err = db.QueryRow("SELECT user_id, changed_at FROM username_history WHERE old_username = ?", username).Scan(&owner, &releasedAt)
+	if err == nil && owner != userID && time.Since(releasedAt) < usernameReservation {
+		return "is already taken", nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	return "", nil
+}
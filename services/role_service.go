@@ -0,0 +1,205 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"natter-chat-go/models"
+	"strings"
+)
+
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+
+	PermModeratePosts    = "posts:moderate"
+	PermModerateComments = "comments:moderate"
+	PermManageUsers      = "users:manage"
+	PermManageRoles      = "roles:manage"
+)
+
+var (
+	ErrUnknownRole        = errors.New("unknown role")
+	ErrRevokeOwnAdmin     = errors.New("admins cannot revoke their own admin role")
+	ErrRoleNotGranted     = errors.New("role not granted to user")
+	ErrRoleAlreadyGranted = errors.New("role already granted to user")
+)
+
+func GetUserRoles(db *sql.DB, userID int) ([]string, error) {
+	query := `
+		SELECT r.name
+		FROM user_roles ur
+		JOIN roles r ON r.id = ur.role_id
+		WHERE ur.user_id = ?
+		ORDER BY r.name
+	`
+
+	return queryStrings(db, query, userID)
+}
+
+func GetUserPermissions(db *sql.DB, userID int) ([]string, error) {
+	query := `
+		SELECT DISTINCT p.name
+		FROM user_roles ur
+		JOIN role_permissions rp ON rp.role_id = ur.role_id
+		JOIN permissions p ON p.id = rp.permission_id
+		WHERE ur.user_id = ?
+		ORDER BY p.name
+	`
+
+	return queryStrings(db, query, userID)
+}
+
+func ListRoles(db *sql.DB) ([]models.Role, error) {
+	query := `
+		SELECT r.id, r.name, COALESCE(p.name, '')
+		FROM roles r
+		LEFT JOIN role_permissions rp ON rp.role_id = r.id
+		LEFT JOIN permissions p ON p.id = rp.permission_id
+		ORDER BY r.name, p.name
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []models.Role{}
+	for rows.Next() {
+		var id int
+		var name, permission string
+		if err := rows.Scan(&id, &name, &permission); err != nil {
+			return nil, err
+		}
+
+		if len(roles) == 0 || roles[len(roles)-1].ID != id {
+			roles = append(roles, models.Role{ID: id, Name: name, Permissions: []string{}})
+		}
+		if permission != "" {
+			role := &roles[len(roles)-1]
+			role.Permissions = append(role.Permissions, permission)
+		}
+	}
+
+	return roles, rows.Err()
+}
+
+// ListUsersWithRoles returns every user with the roles granted to them
+func ListUsersWithRoles(db *sql.DB) ([]models.User, error) {
+	query := `
+		SELECT u.id, u.username, u.email, COALESCE(u.photo_url, ''), COALESCE(GROUP_CONCAT(r.name ORDER BY r.name), '')
+		FROM users u
+		LEFT JOIN user_roles ur ON ur.user_id = u.id
+		LEFT JOIN roles r ON r.id = ur.role_id
+		GROUP BY u.id
+		ORDER BY u.id
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		var roles string
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Photo, &roles); err != nil {
+			return nil, err
+		}
+
+		user.Roles = splitList(roles)
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func GrantRole(db *sql.DB, userID int, role string) error {
+	roleID, err := getRoleID(db, role)
+	if err != nil {
+		return err
+	}
+
+	if _, err := GetUserByID(db, userID); err != nil {
+		return err
+	}
+
+	result, err := db.Exec("INSERT IGNORE INTO user_roles (user_id, role_id) VALUES (?, ?)", userID, roleID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrRoleAlreadyGranted
+	}
+
+	return nil
+}
+
+func RevokeRole(db *sql.DB, actor models.Actor, userID int, role string) error {
+	if role == RoleAdmin && actor.UserID == userID {
+		return ErrRevokeOwnAdmin
+	}
+
+	roleID, err := getRoleID(db, role)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec("DELETE FROM user_roles WHERE user_id = ? AND role_id = ?", userID, roleID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrRoleNotGranted
+	}
+
+	return nil
+}
+
+func getRoleID(db *sql.DB, role string) (int, error) {
+	var roleID int
+	err := db.QueryRow("SELECT id FROM roles WHERE name = ?", role).Scan(&roleID)
+	if err == sql.ErrNoRows {
+		return 0, ErrUnknownRole
+	}
+	return roleID, err
+}
+
+func queryStrings(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
+
+// splitList splits a GROUP_CONCAT result, returning an empty slice for ""
+func splitList(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	return strings.Split(list, ",")
+}
@@ -0,0 +1,277 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"natter-chat-go/models"
+	"time"
+)
+
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+	// last seen is only written once per interval to spare the database
+	sessionTouchInterval = time.Minute
+	maxUserAgentLength   = 255
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected, session revoked")
+	ErrSessionRevoked      = errors.New("session revoked")
+)
+
+// CreateSession starts a new session for the user and issues its first token pair
+func CreateSession(db *sql.DB, user *models.User, client models.ClientInfo) (*models.TokenPair, error) {
+	sessionID, err := generateToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent := client.UserAgent
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	now := time.Now()
+	query := "INSERT INTO sessions (id, user_id, user_agent, ip, created_at, last_seen_at) VALUES (?, ?, ?, ?, ?, ?)"
+	_, err = db.Exec(query, sessionID, user.ID, userAgent, client.IP, now, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return issueTokenPair(db, sessionID, user.Email, user.ID, 0)
+}
+
+// RefreshSession rotates a refresh token. Presenting a token that was already
+// rotated revokes the whole session, since either the client or an attacker
+// holds a stolen copy.
+func RefreshSession(db *sql.DB, refreshToken string) (*models.TokenPair, error) {
+	var tokenID, userID, impersonatorID int
+	var sessionID, email string
+	var expiresAt time.Time
+	var usedAt, revokedAt, sessionExpiresAt sql.NullTime
+
+	query := `
+		SELECT rt.id, rt.session_id, rt.expires_at, rt.used_at, s.revoked_at, s.expires_at,
+		       s.user_id, COALESCE(s.impersonator_id, 0), u.email
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		JOIN users u ON u.id = s.user_id
+		WHERE rt.token_hash = ?
+	`
+
+	err := db.QueryRow(query, hashToken(refreshToken)).Scan(&tokenID, &sessionID, &expiresAt, &usedAt, &revokedAt, &sessionExpiresAt,
+		&userID, &impersonatorID, &email)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if revokedAt.Valid || (sessionExpiresAt.Valid && time.Now().After(sessionExpiresAt.Time)) {
+		return nil, ErrSessionRevoked
+	}
+
+	if usedAt.Valid {
+		if err := RevokeSession(db, sessionID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// mark as used only if nobody else rotated it in the meantime
+	result, err := db.Exec("UPDATE refresh_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL", time.Now(), tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		if err := RevokeSession(db, sessionID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	return issueTokenPair(db, sessionID, email, userID, impersonatorID)
+}
+
+// RevokeSession revokes a session and every refresh token issued from it
+func RevokeSession(db *sql.DB, sessionID string) error {
+	_, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now(), sessionID)
+	return err
+}
+
+// RevokeAllUserSessions signs the user out everywhere
+func RevokeAllUserSessions(db *sql.DB, userID int) error {
+	_, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", time.Now(), userID)
+	return err
+}
+
+// RevokeOtherUserSessions signs the user out everywhere but the given
+// session. Impersonation sessions belong to the admin and are left alone.
+func RevokeOtherUserSessions(db *sql.DB, userID int, keepSessionID string) error {
+	_, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND id <> ? AND revoked_at IS NULL AND impersonator_id IS NULL", time.Now(), userID, keepSessionID)
+	return err
+}
+
+// RevokeSessionByRefreshToken revokes the session a refresh token belongs to
+func RevokeSessionByRefreshToken(db *sql.DB, refreshToken string) error {
+	var sessionID string
+	err := db.QueryRow("SELECT session_id FROM refresh_tokens WHERE token_hash = ?", hashToken(refreshToken)).Scan(&sessionID)
+	if err == sql.ErrNoRows {
+		return ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return err
+	}
+
+	return RevokeSession(db, sessionID)
+}
+
+// SessionState is what a valid session resolves to
+type SessionState struct {
+	UserID int
+	// ImpersonatorID is the admin acting as UserID, zero for normal sessions
+	ImpersonatorID int
+	// ReadOnly sessions may not change anything
+	ReadOnly bool
+}
+
+// ValidateSession checks that the session exists, was not revoked and has
+// not expired. It also records the activity for the session list.
+func ValidateSession(db *sql.DB, sessionID, ip string) (*SessionState, error) {
+	var state SessionState
+	var revokedAt, expiresAt, lastSeenAt sql.NullTime
+	query := "SELECT user_id, COALESCE(impersonator_id, 0), read_only, revoked_at, expires_at, last_seen_at FROM sessions WHERE id = ?"
+	err := db.QueryRow(query, sessionID).Scan(&state.UserID, &state.ImpersonatorID, &state.ReadOnly, &revokedAt, &expiresAt, &lastSeenAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionRevoked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if revokedAt.Valid || (expiresAt.Valid && time.Now().After(expiresAt.Time)) {
+		return nil, ErrSessionRevoked
+	}
+
+	if !lastSeenAt.Valid || time.Since(lastSeenAt.Time) > sessionTouchInterval {
+		if _, err := db.Exec("UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ?", time.Now(), ip, sessionID); err != nil {
+			return nil, err
+		}
+	}
+
+	return &state, nil
+}
+
+// ListActiveSessions returns the sessions the user is still signed in with,
+// most recently used first. Impersonation sessions aren't the user's own
+// and aren't listed.
+func ListActiveSessions(db *sql.DB, userID int, currentSessionID string) ([]models.ActiveSession, error) {
+	query := `
+		SELECT id, user_agent, ip, created_at, COALESCE(last_seen_at, created_at) AS last_seen
+		FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND impersonator_id IS NULL AND COALESCE(last_seen_at, created_at) > ?
+		ORDER BY last_seen DESC
+	`
+	rows, err := db.Query(query, userID, time.Now().Add(-RefreshTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.ActiveSession{}
+	for rows.Next() {
+		var session models.ActiveSession
+		var createdAt, lastSeenAt time.Time
+		if err := rows.Scan(&session.ID, &session.UserAgent, &session.IP, &createdAt, &lastSeenAt); err != nil {
+			return nil, err
+		}
+		session.CreatedAt = createdAt.Format(time.RFC3339)
+		session.LastSeenAt = lastSeenAt.Format(time.RFC3339)
+		session.Current = session.ID == currentSessionID
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeUserSession signs out one of the user's own sessions, sessions of
+// other users look like they don't exist
+func RevokeUserSession(db *sql.DB, userID int, sessionID string) error {
+	result, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL AND impersonator_id IS NULL", time.Now(), sessionID, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func issueTokenPair(db *sql.DB, sessionID, email string, userID, impersonatorID int) (*models.TokenPair, error) {
+	now := time.Now()
+
+	var accessToken string
+	var err error
+	if impersonatorID != 0 {
+		accessToken, err = createImpersonationJWT(email, sessionID, userID, impersonatorID)
+	} else {
+		accessToken, err = CreateJWT(email, sessionID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := generateToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshExpiresAt := now.Add(RefreshTokenTTL)
+	_, err = db.Exec("INSERT INTO refresh_tokens (session_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)", sessionID, hashToken(refreshToken), now, refreshExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TokenPair{
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		SessionID:        sessionID,
+		AccessExpiresAt:  now.Add(AccessTokenTTL).Unix(),
+		RefreshExpiresAt: refreshExpiresAt.Unix(),
+	}, nil
+}
+
+// generateToken returns n random bytes hex encoded
+func generateToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
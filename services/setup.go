@@ -0,0 +1,39 @@
+package services
+
+import (
+	"fmt"
+	"natter-chat-go/config"
+	"natter-chat-go/mailer"
+)
+
+var (
+	appConfig  = &config.Config{}
+	mailSender mailer.Mailer
+)
+
+// SetConfig installs the application configuration used by the services
+func SetConfig(cfg *config.Config) error {
+	hasher, err := newPasswordHasher(cfg.PasswordHash)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Feed.Strategy != FeedFanOutOnRead && cfg.Feed.Strategy != FeedFanOutOnWrite {
+		return fmt.Errorf("unknown feed strategy: %s", cfg.Feed.Strategy)
+	}
+
+	appConfig = cfg
+	passwordHasher = hasher
+	configureOIDCProviders(cfg.OIDCProviders)
+	return nil
+}
+
+// SetMailer installs the mailer used for transactional emails
+func SetMailer(m mailer.Mailer) {
+	mailSender = m
+}
+
+// AppBaseURL is the address of the frontend, where browser flows land
+func AppBaseURL() string {
+	return appConfig.AppBaseURL
+}
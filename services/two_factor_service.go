@@ -0,0 +1,284 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"natter-chat-go/models"
+	"strings"
+	"time"
+)
+
+const (
+	loginChallengeTTL         = 5 * time.Minute
+	maxLoginChallengeAttempts = 5
+	recoveryCodeCount         = 10
+)
+
+var (
+	ErrTOTPAlreadyEnabled    = errors.New("two-factor authentication already enabled")
+	ErrTOTPNotEnrolled       = errors.New("two-factor authentication not enrolled")
+	ErrInvalidTwoFactorCode  = errors.New("invalid two-factor code")
+	ErrInvalidLoginChallenge = errors.New("invalid or expired login challenge")
+)
+
+// EnrollTOTP generates a new secret for the user. It only takes effect once
+// confirmed with a valid code.
+func EnrollTOTP(db *sql.DB, userID int) (*models.TOTPEnrollment, error) {
+	enabled, err := isTOTPEnabled(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	user, err := GetUserByID(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO user_totp (user_id, secret, created_at)
+		VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE secret = VALUES(secret), created_at = VALUES(created_at), last_used_step = 0
+	`
+	if _, err := db.Exec(query, userID, secret, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return &models.TOTPEnrollment{
+		Secret: secret,
+		URI:    totpURI(secret, user.Email),
+	}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication and returns the recovery
+// codes, which are only ever shown this once
+func ConfirmTOTP(db *sql.DB, userID int, code string) ([]string, error) {
+	var secret string
+	var confirmedAt sql.NullTime
+	err := db.QueryRow("SELECT secret, confirmed_at FROM user_totp WHERE user_id = ?", userID).Scan(&secret, &confirmedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if confirmedAt.Valid {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	step, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE user_totp SET confirmed_at = ?, last_used_step = ? WHERE user_id = ?", time.Now(), step, userID); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw, err := generateToken(5)
+		if err != nil {
+			return nil, err
+		}
+		recoveryCode := raw[:5] + "-" + raw[5:]
+
+		if _, err := tx.Exec("INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashToken(recoveryCode)); err != nil {
+			return nil, err
+		}
+		codes = append(codes, recoveryCode)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor off after checking a current code
+func DisableTOTP(db *sql.DB, userID int, code string) error {
+	if err := verifyTwoFactorCode(db, userID, code, ""); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CompleteTwoFactorLogin finishes a login started by Login using either a
+// TOTP code or a recovery code
+func CompleteTwoFactorLogin(db *sql.DB, challenge, code, recoveryCode string, client models.ClientInfo) (*models.User, *models.TokenPair, error) {
+	var userID, attempts int
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	challengeHash := hashToken(challenge)
+
+	query := "SELECT user_id, expires_at, attempts, used_at FROM login_challenges WHERE token_hash = ?"
+	err := db.QueryRow(query, challengeHash).Scan(&userID, &expiresAt, &attempts, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidLoginChallenge
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if usedAt.Valid || time.Now().After(expiresAt) || attempts >= maxLoginChallengeAttempts {
+		return nil, nil, ErrInvalidLoginChallenge
+	}
+
+	// wrong codes count against the account like wrong passwords, otherwise
+	// fresh challenges would allow unlimited guessing
+	var email string
+	if err := db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		return nil, nil, err
+	}
+	throttleKey := normalizeEmail(email)
+	if err := checkLoginAllowed(db, throttleKey, client.IP); err != nil {
+		return nil, nil, err
+	}
+
+	if err := verifyTwoFactorCode(db, userID, code, recoveryCode); err != nil {
+		if err == ErrInvalidTwoFactorCode {
+			if _, err := db.Exec("UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = ?", challengeHash); err != nil {
+				return nil, nil, err
+			}
+			if err := recordLoginFailure(db, throttleKey, client.IP); err != nil {
+				return nil, nil, err
+			}
+		}
+		return nil, nil, err
+	}
+
+	// a challenge can only ever produce one session
+	result, err := db.Exec("UPDATE login_challenges SET used_at = ? WHERE token_hash = ? AND used_at IS NULL", time.Now(), challengeHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return nil, nil, ErrInvalidLoginChallenge
+	}
+
+	if err := recordLoginSuccess(db, throttleKey, client.IP); err != nil {
+		return nil, nil, err
+	}
+
+	user, err := GetUserByID(db, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user.Roles, err = GetUserRoles(db, user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokens, err := CreateSession(db, user, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, tokens, nil
+}
+
+func createLoginChallenge(db *sql.DB, userID int) (*models.TwoFactorChallenge, error) {
+	challenge, err := generateToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(loginChallengeTTL)
+	_, err = db.Exec("INSERT INTO login_challenges (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)", hashToken(challenge), userID, now, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TwoFactorChallenge{Challenge: challenge, ExpiresAt: expiresAt.Unix()}, nil
+}
+
+func isTOTPEnabled(db *sql.DB, userID int) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT confirmed_at IS NOT NULL FROM user_totp WHERE user_id = ?", userID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// verifyTwoFactorCode accepts a TOTP code or, failing that, burns a recovery code
+func verifyTwoFactorCode(db *sql.DB, userID int, code, recoveryCode string) error {
+	if code != "" {
+		var secret string
+		var lastUsedStep int64
+		err := db.QueryRow("SELECT secret, last_used_step FROM user_totp WHERE user_id = ? AND confirmed_at IS NOT NULL", userID).Scan(&secret, &lastUsedStep)
+		if err == sql.ErrNoRows {
+			return ErrTOTPNotEnrolled
+		}
+		if err != nil {
+			return err
+		}
+
+		step, ok := validateTOTP(secret, code, time.Now())
+		if !ok || step <= lastUsedStep {
+			return ErrInvalidTwoFactorCode
+		}
+
+		// the step check in the update stops two requests racing with one code
+		result, err := db.Exec("UPDATE user_totp SET last_used_step = ? WHERE user_id = ? AND last_used_step < ?", step, userID, step)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			return ErrInvalidTwoFactorCode
+		}
+
+		return nil
+	}
+
+	if recoveryCode != "" {
+		normalized := strings.ToLower(strings.TrimSpace(recoveryCode))
+		result, err := db.Exec("UPDATE totp_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL", time.Now(), userID, hashToken(normalized))
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			return ErrInvalidTwoFactorCode
+		}
+
+		return nil
+	}
+
+	return ErrInvalidTwoFactorCode
+}
@@ -7,7 +7,8 @@ import (
 
 func GetUserByID(db *sql.DB, id int) (*models.User, error) {
 	var user models.User
-	err := db.QueryRow("SELECT id, username, email, photo_url FROM users WHERE id = ?", id).Scan(&user.ID, &user.Username, &user.Email, &user.Photo)
+	query := "SELECT id, username, email, photo_url, email_verified_at IS NOT NULL FROM users WHERE id = ?"
+	err := db.QueryRow(query, id).Scan(&user.ID, &user.Username, &user.Email, &user.Photo, &user.EmailVerified)
 	if err != nil {
 		return nil, err
 	}
@@ -25,6 +26,17 @@ func GetUserByUsername(db *sql.DB, username string) (*models.User, error) {
 	return &user, nil
 }
 
+func GetUserByEmail(db *sql.DB, email string) (*models.User, error) {
+	var user models.User
+	query := "SELECT id, username, email, photo_url, email_verified_at IS NOT NULL FROM users WHERE email = ?"
+	err := db.QueryRow(query, email).Scan(&user.ID, &user.Username, &user.Email, &user.Photo, &user.EmailVerified)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
 func GetUserProfileByID(db *sql.DB, id int) (*models.UserProfile, error) {
 	var user models.UserProfile
 
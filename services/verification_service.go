@@ -0,0 +1,141 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"natter-chat-go/mailer"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	verificationTokenTTL = 48 * time.Hour
+	verificationPurpose  = "verify_email"
+	resendCooldown       = time.Minute
+	maxResendsPerHour    = 5
+)
+
+var (
+	ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+	ErrAlreadyVerified          = errors.New("email already verified")
+	ErrTooManyRequests          = errors.New("too many requests, try again later")
+)
+
+// SendVerificationEmail issues a signed single-use token for the user's
+// current email and mails the verification link
+func SendVerificationEmail(db *sql.DB, userID int) error {
+	var email string
+	var verifiedAt sql.NullTime
+	err := db.QueryRow("SELECT email, email_verified_at FROM users WHERE id = ?", userID).Scan(&email, &verifiedAt)
+	if err != nil {
+		return err
+	}
+
+	if verifiedAt.Valid {
+		return ErrAlreadyVerified
+	}
+
+	jti, err := generateToken(16)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	token, err := keyRing.Sign(jwt.MapClaims{
+		"sub":     userID,
+		"email":   email,
+		"purpose": verificationPurpose,
+		"jti":     jti,
+		"exp":     now.Add(verificationTokenTTL).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO email_verification_tokens (jti, user_id, email, created_at) VALUES (?, ?, ?, ?)", jti, userID, email, now)
+	if err != nil {
+		return err
+	}
+
+	link := appConfig.AppBaseURL + "/verify-email?token=" + url.QueryEscape(token)
+	return mailSender.Send(mailer.Message{
+		To:      email,
+		Subject: "Verify your Natter email",
+		Body:    "Welcome to Natter!\n\nConfirm your email address by opening this link:\n\n" + link + "\n\nThe link expires in 48 hours.\n",
+	})
+}
+
+// ResendVerificationEmail sends a new verification email unless one was sent
+// too recently
+func ResendVerificationEmail(db *sql.DB, userID int) error {
+	var lastSent sql.NullTime
+	var sentLastHour int
+	query := `
+		SELECT MAX(created_at), COUNT(CASE WHEN created_at > ? THEN 1 END)
+		FROM email_verification_tokens
+		WHERE user_id = ?
+	`
+
+	err := db.QueryRow(query, time.Now().Add(-time.Hour), userID).Scan(&lastSent, &sentLastHour)
+	if err != nil {
+		return err
+	}
+
+	if (lastSent.Valid && time.Since(lastSent.Time) < resendCooldown) || sentLastHour >= maxResendsPerHour {
+		return ErrTooManyRequests
+	}
+
+	return SendVerificationEmail(db, userID)
+}
+
+// VerifyEmail consumes a verification token and marks the email as verified
+func VerifyEmail(db *sql.DB, token string) error {
+	claims, err := keyRing.Parse(token)
+	if err != nil {
+		return ErrInvalidVerificationToken
+	}
+
+	purpose, _ := claims["purpose"].(string)
+	jti, _ := claims["jti"].(string)
+	email, _ := claims["email"].(string)
+	if purpose != verificationPurpose || jti == "" {
+		return ErrInvalidVerificationToken
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow("SELECT user_id FROM email_verification_tokens WHERE jti = ? AND email = ? AND used_at IS NULL FOR UPDATE", jti, email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE email_verification_tokens SET used_at = ? WHERE jti = ?", time.Now(), jti); err != nil {
+		return err
+	}
+
+	// the token only counts for the address it was sent to
+	result, err := tx.Exec("UPDATE users SET email_verified_at = ? WHERE id = ? AND email = ?", time.Now(), userID, email)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrInvalidVerificationToken
+	}
+
+	return tx.Commit()
+}